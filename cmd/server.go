@@ -1,18 +1,39 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"github.com/supme/handSendEmail/message"
 	"html/template"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
-const addr = ":8080"
+const (
+	addr = ":8080"
+	// archiveDir Maildir с отправленными письмами, его заполняет test.go
+	archiveDir = "archive"
+	// forbiddenWordsFile список запрещённых слов для оценки спама, по слову в строке
+	forbiddenWordsFile = "forbidden_words.txt"
+)
 
 func main() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", root)
+	mux.HandleFunc("/lint", lint)
+	mux.HandleFunc("/archive", archive)
+	mux.HandleFunc("/spam", spam)
+	mux.HandleFunc("/draft", draft)
 
 	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "image/x-icon")
@@ -41,3 +62,227 @@ func root(w http.ResponseWriter, _ *http.Request) {
 		log.Print(err)
 	}
 }
+
+// draft возвращает письмо из формы в виде MessageSpec в JSON, файлы вложены в base64
+func draft(w http.ResponseWriter, r *http.Request) {
+	e, cleanup, err := messageFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Print(err)
+		return
+	}
+	defer cleanup()
+
+	spec := message.FromMessage(e)
+	if err = spec.Inline(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Print(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="draft.json"`)
+	if err = json.NewEncoder(w).Encode(spec); err != nil {
+		log.Print(err)
+	}
+}
+
+// lint проверяет письмо из формы и возвращает замечания в JSON
+func lint(w http.ResponseWriter, r *http.Request) {
+	e, cleanup, err := messageFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Print(err)
+		return
+	}
+	defer cleanup()
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"findings": e.Lint(),
+	})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// spam оценивает письмо из формы на спам и возвращает оценку вместе с исходным текстом письма
+func spam(w http.ResponseWriter, r *http.Request) {
+	e, cleanup, err := messageFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Print(err)
+		return
+	}
+	defer cleanup()
+
+	var checker message.SpamChecker
+	if words, err := ioutil.ReadFile(forbiddenWordsFile); err == nil {
+		for _, word := range strings.Split(string(words), "\n") {
+			if word = strings.TrimSpace(word); word != "" {
+				checker.ForbiddenWords = append(checker.ForbiddenWords, word)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		log.Print(err)
+	}
+
+	source := &bytes.Buffer{}
+	if _, err = e.Write(source); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Print(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"spam":   checker.Check(*e),
+		"source": source.String(),
+	})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// archive список писем из архива в JSON
+func archive(w http.ResponseWriter, _ *http.Request) {
+	type archived struct {
+		From    string
+		To      string
+		Subject string
+		Date    string
+	}
+	list := []archived{}
+	r, err := message.NewMaildirReader(archiveDir)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Print(err)
+		return
+	}
+	for err == nil {
+		var msg *mail.Message
+		msg, err = r.Next()
+		if err != nil {
+			break
+		}
+		dec := new(mime.WordDecoder)
+		subject, _ := dec.DecodeHeader(msg.Header.Get("Subject"))
+		from, _ := dec.DecodeHeader(msg.Header.Get("From"))
+		to, _ := dec.DecodeHeader(msg.Header.Get("To"))
+		list = append(list, archived{From: from, To: to, Subject: subject, Date: msg.Header.Get("Date")})
+	}
+	if err != nil && err != io.EOF && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Print(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(list); err != nil {
+		log.Print(err)
+	}
+}
+
+// messageFromRequest собирает письмо из MessageSpec в JSON или YAML, если запрос
+// прислан с таким типом, иначе из полей формы
+func messageFromRequest(r *http.Request) (*message.Message, func(), error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json", "application/yaml", "application/x-yaml", "text/yaml":
+	default:
+		return messageFromForm(r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, 32<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	spec, err := message.ParseSpec(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Файлы и URL из описания открывались бы на сервере, разрешены только данные в base64
+	if err = spec.CheckInline(); err != nil {
+		return nil, nil, err
+	}
+	e, err := spec.ToMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	return e, func() { e.Close() }, nil
+}
+
+// messageFromForm собирает письмо из полей формы, загруженные файлы сохраняются
+// во временную папку под своими именами, cleanup её удаляет
+func messageFromForm(r *http.Request) (*message.Message, func(), error) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return nil, nil, err
+	}
+	dir, err := ioutil.TempDir("", "handSendEmail")
+	if err != nil {
+		return nil, nil, err
+	}
+	var files []*os.File
+	cleanup := func() {
+		for i := range files {
+			files[i].Close()
+		}
+		os.RemoveAll(dir)
+	}
+
+	e := message.NewMessage().
+		From(message.NewMail(r.FormValue("from-name"), r.FormValue("from-email"))).
+		Subject(r.FormValue("subject")).
+		TextPlain(r.FormValue("text-plain")).
+		TextHTML(r.FormValue("text-html"))
+	if name := r.FormValue("header-name"); name != "" {
+		e.AddHeaders(map[string]string{name: r.FormValue("header-value")})
+	}
+	for _, field := range []struct {
+		prefix string
+		add    func(message.Mail) *message.Message
+	}{{"to", e.To}, {"cc", e.Cc}, {"bcc", e.Bcc}} {
+		for i := 1; ; i++ {
+			emails, ok := r.MultipartForm.Value[fmt.Sprintf("%s_email_%d", field.prefix, i)]
+			if !ok {
+				break
+			}
+			if emails[0] == "" {
+				continue
+			}
+			field.add(message.NewMail(r.FormValue(fmt.Sprintf("%s_name_%d", field.prefix, i)), emails[0]))
+		}
+	}
+
+	for _, field := range []struct {
+		name string
+		add  func(*os.File) *message.Message
+	}{{"related_file", e.AddRelatedFile}, {"attached_file", e.AddAttachmentFile}} {
+		for _, header := range r.MultipartForm.File[field.name] {
+			f, err := saveFormFile(dir, header)
+			if err != nil {
+				cleanup()
+				return nil, nil, err
+			}
+			files = append(files, f)
+			field.add(f)
+		}
+	}
+
+	return e, cleanup, nil
+}
+
+func saveFormFile(dir string, header *multipart.FileHeader) (*os.File, error) {
+	src, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	f, err := os.Create(filepath.Join(dir, filepath.Base(header.Filename)))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(f, src); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
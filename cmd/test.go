@@ -1,12 +1,25 @@
 package main
 
 import (
-	"bytes"
+	"crypto/tls"
 	"fmt"
 	"github.com/supme/handSendEmail/email"
+	"github.com/supme/handSendEmail/email/queue"
 	"github.com/supme/handSendEmail/message"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/smtp"
 	"os"
+	"time"
+)
+
+const (
+	// archiveDir Maildir, в который сохраняются все отправленные письма
+	archiveDir = "archive"
+	// spoolDir очередь писем, которые ещё не доставлены
+	spoolDir = "spool"
 )
 
 func main() {
@@ -25,6 +38,119 @@ func main() {
 	iface = ifaces[n]
 	fmt.Printf("Выбран интерфейс %s ('%s')\n", iface.IP, iface.Hostname)
 
+	var relay, relayUser, relayPassword string
+	fmt.Print("Сервер отправки host:port (пусто, чтобы слать напрямую на MX получателя): ")
+	fmt.Scanln(&relay)
+	if relay != "" {
+		fmt.Print("Логин: ")
+		fmt.Scanln(&relayUser)
+		fmt.Print("Пароль: ")
+		fmt.Scanln(&relayPassword)
+	}
+
+	var e *message.Message
+	if len(os.Args) > 1 {
+		// Письмо из MessageSpec в JSON или YAML
+		data, err := ioutil.ReadFile(os.Args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		spec, err := message.ParseSpec(data)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if e, err = spec.ToMessage(); err != nil {
+			log.Fatal(err)
+		}
+		defer e.Close()
+	} else {
+		e = testMessage()
+	}
+
+	findings := e.Lint()
+	if len(findings) > 0 {
+		fmt.Println("Замечания к письму:")
+		for i := range findings {
+			fmt.Println("-", findings[i])
+		}
+		var answer string
+		fmt.Print("Всё равно отправить? (y/n): ")
+		fmt.Scanln(&answer)
+		if answer != "y" {
+			return
+		}
+	}
+
+	size, err := e.EncodedSize()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Размер письма", size, "байт")
+
+	var to []queue.Recipient
+	for _, address := range e.GetRecipientEmails() {
+		to = append(to, queue.Recipient{Address: address, From: e.GetEnvelopeFrom(address)})
+	}
+	// Соединения с одним MX сервером используются для нескольких писем
+	pool := email.NewPool(func() *email.SMTP {
+		mail := email.NewSmtp(iface).AddIface(ifaces...).SetTLS(email.TLSOpportunistic, &tls.Config{MinVersion: tls.VersionTLS12}).
+			SetTrace(stepTrace)
+		if relay != "" {
+			host, _, _ := net.SplitHostPort(relay)
+			mail.SetTLS(email.TLSRequired, &tls.Config{MinVersion: tls.VersionTLS12}).
+				SetRelay(email.Relay{Addr: relay, Auth: smtp.PlainAuth("", relayUser, relayPassword, host)})
+		}
+		return mail
+	})
+	defer pool.Close()
+	q, err := queue.Open(spoolDir, stepTransport{pool: pool})
+	if err != nil {
+		log.Fatal(err)
+	}
+	q.ReportingMTA = iface.Hostname
+	// Письмо ставится в очередь, не доставленные из-за временных ошибок получатели
+	// остаются в ней до следующего запуска. Пишется в файл очереди потоком, целиком в памяти не держится
+	r, w := io.Pipe()
+	go func() {
+		_, err := e.Write(w)
+		w.CloseWithError(err)
+	}()
+	id, err := q.Add("", to, r)
+	// Если очередь не дочитала письмо, то запись прервётся
+	r.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("В очереди", id)
+
+	results, err := q.RunOnce()
+	if err != nil {
+		log.Println(err)
+	}
+	for i := range results {
+		switch results[i].Status {
+		case queue.StatusSent:
+			fmt.Println(results[i].Recipient, "доставлено")
+		case queue.StatusBounced:
+			fmt.Println(results[i].Recipient, "не доставлено:", results[i].Err)
+		default:
+			fmt.Println(results[i].Recipient, "отложено:", results[i].Err)
+		}
+	}
+	if next, ok, err := q.NextAttempt(); err == nil && ok {
+		fmt.Println("Следующая попытка", next.Format(time.RFC3339))
+	}
+
+	name, err := e.WriteMaildir(archiveDir)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Println("Сохранено в архив", name)
+}
+
+// testMessage письмо для отправки, если MessageSpec не указан
+func testMessage() *message.Message {
 	e := message.NewMessage().
 		From(message.NewMail("Алексей", "alexey@domain.tld")).
 		To(message.NewMail("Василий", "vasiliy@domain.tld")).
@@ -33,6 +159,8 @@ func main() {
 		Cc(message.NewMail("Фёдор 1", "fedor_1@domain.tld")).
 		Bcc(message.NewMail("Василий 2", "vasiliy_2@domain.tld")).
 		Bcc(message.NewMail("Фёдор 2", "fedor_2@domain.tld")).
+		ReturnPath(message.NewMail("", "bounce@domain.tld")).
+		VERP(true).
 		Subject("Тестовый email").
 		TextHTML("<h1>Привет! Это я.</h1><br><img src=\"cid:me.gif\"/><br><h2>Съешь ещё этих мягких французских булок да выпей чаю</h2>").
 		TextPlain("Привет! Это я.\n[картинка меня]\nСъешь ещё этих мягких французских булок да выпей чаю")
@@ -49,53 +177,43 @@ func main() {
 	}
 	e.AddAttachmentFile(fAttachment)
 
-	buf := &bytes.Buffer{}
-	e.Write(buf)
-
-	for _, to := range e.GetRecipientEmails() {
-		mail := email.NewSmtp(iface)
-		fmt.Println("Connect...\nHELO", iface.Hostname)
-		err = mail.CommandConnectAndHello(to)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		fmt.Println("Ok")
-		//		time.Sleep(time.Second)
+	return e
+}
 
-		fmt.Println("FROM: ", e.GetFromEmail())
-		err = mail.CommandFrom(e.GetFromEmail())
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		fmt.Println("Ok")
-		//		time.Sleep(time.Second)
+// stepTransport доставка из очереди через пул соединений, каждую команду выводит stepTrace
+type stepTransport struct {
+	pool *email.Pool
+}
 
-		fmt.Println("RCPT: ", to)
-		err = mail.CommandRcpt(to)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		fmt.Println("Ok")
-		//		time.Sleep(time.Second)
+func (t stepTransport) Send(g email.Group, size int64, data io.Reader) []email.Result {
+	fmt.Println("Отправка", len(g.To), "получателям на", g.Domain, "...")
+	return t.pool.Deliver(g, size, data)
+}
 
-		fmt.Println("DATA ...you message data...")
-		//fmt.Printf("DATA\n%s\n.\n\n", buf.String())
-		err = mail.CommandData(buf.Bytes())
-		if err != nil {
-			log.Println(err)
-			return
+// stepTrace выводит команду соединения и её результат, после подключения ещё TLS и PIPELINING
+func stepTrace(s *email.SMTP, command, arg string, err error) {
+	switch {
+	case err != nil:
+		fmt.Println(command, arg, "\n", err)
+	case command == "CONNECT":
+		fmt.Println("Connect", arg, "\nOk")
+		if info := s.TLSInfo(); info != "" {
+			fmt.Println("STARTTLS", info)
+			if verifyErr := s.TLSVerifyError(); verifyErr != nil {
+				fmt.Println("Сертификат не проверен:", verifyErr)
+			}
+		} else if tlsErr := s.TLSError(); tlsErr != nil {
+			fmt.Println("Без TLS:", tlsErr)
 		}
-		fmt.Println("Ok")
-
-		fmt.Println("QUIT")
-		err = mail.CommandQuit()
-		if err != nil {
-			log.Println(err)
-			return
+		// С PIPELINING MAIL FROM и все RCPT TO уходят одним пакетом
+		if s.Pipelining() {
+			fmt.Println("PIPELINING")
 		}
-		fmt.Println("Ok")
+	case command == "NOOP":
+		fmt.Println("Соединение уже открыто, писем через него:", s.Messages())
+	case command == "DATA":
+		fmt.Println("DATA ...you message data...\nOk,", arg, "bytes")
+	default:
+		fmt.Println(command, arg, "\nOk")
 	}
 }
@@ -0,0 +1,76 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// PLAIN и CRAM-MD5 есть в net/smtp: smtp.PlainAuth и smtp.CRAMMD5Auth
+
+type loginAuth struct {
+	username, password, host string
+}
+
+// LoginAuth AUTH LOGIN, как и smtp.PlainAuth, пароль отправляется только по TLS или на localhost
+func LoginAuth(username, password, host string) smtp.Auth {
+	return &loginAuth{username: username, password: password, host: host}
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkAuthServer(server, a.host); err != nil {
+		return "", nil, err
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:", "username":
+		return []byte(a.username), nil
+	case "password:", "password":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+}
+
+type xoauth2Auth struct {
+	username, token, host string
+}
+
+// XOAUTH2Auth AUTH XOAUTH2 с OAuth 2.0 bearer токеном, например для Gmail и Outlook
+// https://developers.google.com/gmail/imap/xoauth2-protocol
+func XOAUTH2Auth(username, token, host string) smtp.Auth {
+	return &xoauth2Auth{username: username, token: token, host: host}
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkAuthServer(server, a.host); err != nil {
+		return "", nil, err
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// Сервер прислал JSON с описанием ошибки, на него отвечаем пустой строкой
+		// и получаем окончательный отказ
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// checkAuthServer секреты отправляются только по TLS или на localhost и только тому серверу, для которого заданы
+func checkAuthServer(server *smtp.ServerInfo, host string) error {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return errors.New("unencrypted connection")
+	}
+	if server.Name != host {
+		return errors.New("wrong host name")
+	}
+	return nil
+}
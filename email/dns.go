@@ -0,0 +1,248 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// https://tools.ietf.org/html/rfc1035#section-4
+
+const (
+	dnsTypeTLSA  = 52
+	dnsClassINET = 1
+	// dnsUDPSize размер ответа по UDP без EDNS, если ответ больше, то сервер ставит TC
+	// и запрос повторяется по TCP
+	dnsUDPSize = 512
+)
+
+var errDNSMessage = errors.New("bad DNS message")
+
+// systemDNSServer первый nameserver из /etc/resolv.conf
+func systemDNSServer() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+func lookupTLSA(ctx context.Context, server string, timeout time.Duration, name string) ([]TLSA, error) {
+	// Случайный ID и проверка вопроса в ответе защищают от подделанного ответа
+	b := make([]byte, 2)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(b)
+	query, err := dnsQuery(id, name, dnsTypeTLSA)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dnsExchange(ctx, "udp", server, timeout, query)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = dnsCheck(resp, id, name, dnsTypeTLSA); err != nil {
+		return nil, err
+	}
+	// TC, ответ не поместился в UDP
+	if resp[2]&0x02 != 0 {
+		if resp, err = dnsExchange(ctx, "tcp", server, timeout, query); err != nil {
+			return nil, err
+		}
+	}
+	answers, err := dnsAnswers(resp, id, name, dnsTypeTLSA)
+	if err != nil {
+		return nil, err
+	}
+	var records []TLSA
+	for i := range answers {
+		if answers[i].rrType != dnsTypeTLSA {
+			continue
+		}
+		if len(answers[i].data) < 3 {
+			return nil, errDNSMessage
+		}
+		records = append(records, TLSA{
+			Usage:        answers[i].data[0],
+			Selector:     answers[i].data[1],
+			MatchingType: answers[i].data[2],
+			Data:         answers[i].data[3:],
+		})
+	}
+	if len(records) == 0 {
+		return nil, notFound(name)
+	}
+	return records, nil
+}
+
+func dnsQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	// RD, рекурсивный запрос
+	msg[2] = 0x01
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("bad domain name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(msg[len(msg)-4:], qtype)
+	binary.BigEndian.PutUint16(msg[len(msg)-2:], dnsClassINET)
+	return msg, nil
+}
+
+func dnsExchange(ctx context.Context, network, server string, timeout time.Duration, query []byte) ([]byte, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	if network == "udp" {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, dnsUDPSize)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		return resp[:n], nil
+	}
+	// По TCP перед сообщением идёт его длина
+	msg := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	if _, err = conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(msg))
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type dnsRR struct {
+	rrType uint16
+	data   []byte
+}
+
+// dnsCheck ответ ли msg на запрос id о name с типом qtype, возвращает смещение сразу за вопросом
+func dnsCheck(msg []byte, id uint16, name string, qtype uint16) (int, error) {
+	// QR, это ответ
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return 0, errDNSMessage
+	}
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return 0, errDNSMessage
+	}
+	qname, off, err := dnsReadName(msg, 12)
+	if err != nil {
+		return 0, err
+	}
+	if off+4 > len(msg) || !strings.EqualFold(qname, strings.TrimSuffix(name, ".")) ||
+		binary.BigEndian.Uint16(msg[off:]) != qtype || binary.BigEndian.Uint16(msg[off+2:]) != dnsClassINET {
+		return 0, errDNSMessage
+	}
+	return off + 4, nil
+}
+
+func dnsAnswers(msg []byte, id uint16, name string, qtype uint16) ([]dnsRR, error) {
+	off, err := dnsCheck(msg, id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case 3:
+		return nil, notFound(name)
+	default:
+		return nil, &net.DNSError{Err: fmt.Sprintf("server returned rcode %d", rcode), Name: name}
+	}
+	anCount := binary.BigEndian.Uint16(msg[6:])
+	answers := make([]dnsRR, 0, anCount)
+	for i := 0; i < int(anCount); i++ {
+		if _, off, err = dnsReadName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, errDNSMessage
+		}
+		rrType := binary.BigEndian.Uint16(msg[off:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, errDNSMessage
+		}
+		answers = append(answers, dnsRR{rrType: rrType, data: msg[off : off+length]})
+		off += length
+	}
+	return answers, nil
+}
+
+// dnsMaxPointers столько ссылок в одном имени достаточно, больше бывает только у ссылок по кругу
+const dnsMaxPointers = 32
+
+// dnsReadName имя с off и смещение сразу за ним, имя может продолжаться ссылкой на другое место сообщения
+func dnsReadName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for pointers := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMessage
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || pointers >= dnsMaxPointers {
+				return "", 0, errDNSMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			pointers++
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			continue
+		case l&0xc0 != 0:
+			return "", 0, errDNSMessage
+		}
+		if off+1+l > len(msg) {
+			return "", 0, errDNSMessage
+		}
+		labels = append(labels, string(msg[off+1:off+1+l]))
+		off += 1 + l
+	}
+}
@@ -0,0 +1,148 @@
+package email
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testTLSAName = "_25._tcp.mx.domain.tld"
+
+// dnsResponse ответ на query с флагом TC, кодом rcode и готовыми записями answers
+func dnsResponse(query []byte, tc bool, rcode byte, answers ...[]byte) []byte {
+	msg := append([]byte(nil), query...)
+	// QR
+	msg[2] |= 0x80
+	if tc {
+		msg[2] |= 0x02
+	}
+	msg[3] = rcode
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	for i := range answers {
+		msg = append(msg, answers[i]...)
+	}
+	return msg
+}
+
+// tlsaRR TLSA запись, имя которой ссылка на имя в вопросе
+func tlsaRR(data ...byte) []byte {
+	rr := []byte{0xc0, 12, 0, dnsTypeTLSA, 0, dnsClassINET, 0, 0, 0x0e, 0x10, 0, byte(len(data))}
+	return append(rr, data...)
+}
+
+func testQuery(t *testing.T, id uint16) []byte {
+	query, err := dnsQuery(id, testTLSAName, dnsTypeTLSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func TestDNSAnswers(t *testing.T) {
+	query := testQuery(t, 0x1234)
+	// Вторая запись с именем из части первого: "mx" и ссылка на "domain.tld" в вопросе
+	second := append([]byte{2, 'm', 'x', 0xc0, 12 + 1 + 3 + 1 + 4 + 1 + 2}, tlsaRR(2, 0, 0, 0xbb)[2:]...)
+	resp := dnsResponse(query, false, 0, tlsaRR(3, 1, 1, 0xaa), second)
+	answers, err := dnsAnswers(resp, 0x1234, testTLSAName, dnsTypeTLSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []dnsRR{{rrType: dnsTypeTLSA, data: []byte{3, 1, 1, 0xaa}}, {rrType: dnsTypeTLSA, data: []byte{2, 0, 0, 0xbb}}}
+	if !reflect.DeepEqual(answers, expected) {
+		t.Fatalf("expected %v, got %v", expected, answers)
+	}
+	if name, _, err := dnsReadName(resp, len(query)+len(tlsaRR(3, 1, 1, 0xaa))); err != nil || name != "mx.domain.tld" {
+		t.Fatalf("expected mx.domain.tld, got %q %v", name, err)
+	}
+}
+
+func TestDNSAnswersRcode(t *testing.T) {
+	query := testQuery(t, 0x1234)
+	_, err := dnsAnswers(dnsResponse(query, false, 3), 0x1234, testTLSAName, dnsTypeTLSA)
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if _, err = dnsAnswers(dnsResponse(query, false, 2), 0x1234, testTLSAName, dnsTypeTLSA); !errors.As(err, &dnsErr) || dnsErr.IsNotFound {
+		t.Fatalf("expected server failure, got %v", err)
+	}
+}
+
+func TestDNSAnswersSpoofed(t *testing.T) {
+	resp := dnsResponse(testQuery(t, 0x1234), false, 0, tlsaRR(3, 1, 1, 0xaa))
+	other, err := dnsQuery(0x1234, "_25._tcp.evil.tld", dnsTypeTLSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherType, err := dnsQuery(0x1234, testTLSAName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Имя записи ссылается само на себя
+	query := testQuery(t, 0x1234)
+	loop := dnsResponse(query, false, 0, []byte{0xc0, byte(len(query))})
+	tests := map[string][]byte{
+		"wrong id":       dnsResponse(testQuery(t, 0x4321), false, 0, tlsaRR(3, 1, 1, 0xaa)),
+		"not a response": testQuery(t, 0x1234),
+		"wrong name":     dnsResponse(other, false, 0, tlsaRR(3, 1, 1, 0xaa)),
+		"wrong type":     dnsResponse(otherType, false, 0, tlsaRR(3, 1, 1, 0xaa)),
+		"pointer loop":   loop,
+		"truncated":      resp[:len(resp)-2],
+	}
+	for name, msg := range tests {
+		if _, err := dnsAnswers(msg, 0x1234, testTLSAName, dnsTypeTLSA); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestLookupTLSATruncated(t *testing.T) {
+	// По UDP ответ с TC, тогда запрос повторяется по TCP на тот же адрес
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Skip(err)
+	}
+	defer tcp.Close()
+	go func() {
+		b := make([]byte, dnsUDPSize)
+		n, addr, err := udp.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		udp.WriteTo(dnsResponse(b[:n], true, 0), addr)
+	}()
+	go func() {
+		c, err := tcp.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		l := make([]byte, 2)
+		if _, err = c.Read(l); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(l))
+		if _, err = c.Read(query); err != nil {
+			return
+		}
+		resp := dnsResponse(query, false, 0, tlsaRR(3, 1, 1, 0xaa))
+		binary.BigEndian.PutUint16(l, uint16(len(resp)))
+		c.Write(append(l, resp...))
+	}()
+	records, err := lookupTLSA(context.Background(), udp.LocalAddr().String(), time.Second, testTLSAName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []TLSA{{Usage: 3, Selector: 1, MatchingType: 1, Data: []byte{0xaa}}}; !reflect.DeepEqual(records, expected) {
+		t.Fatalf("expected %v, got %v", expected, records)
+	}
+}
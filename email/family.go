@@ -0,0 +1,110 @@
+package email
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// IPPreference какие адреса MX серверов использовать
+type IPPreference int
+
+const (
+	// IPAny все адреса, для которых есть интерфейс того же семейства, в порядке DNS
+	IPAny IPPreference = iota
+	IPv4Only
+	IPv6Only
+	// PreferIPv6 сначала IPv6 адреса, потом IPv4
+	PreferIPv6
+)
+
+func (p IPPreference) String() string {
+	switch p {
+	case IPAny:
+		return "any"
+	case IPv4Only:
+		return "v4-only"
+	case IPv6Only:
+		return "v6-only"
+	case PreferIPv6:
+		return "prefer-v6"
+	}
+	return fmt.Sprintf("IPPreference(%d)", int(p))
+}
+
+// SetIPPreference какие адреса MX серверов использовать для этой отправки
+func (s *SMTP) SetIPPreference(preference IPPreference) *SMTP {
+	s.ipPreference = preference
+	return s
+}
+
+// AddIface дополнительные интерфейсы, через них подключаемся к адресам, семейство которых
+// отличается от семейства основного интерфейса, например IPv6 интерфейс к IPv4 интерфейсу
+func (s *SMTP) AddIface(ifaces ...*Iface) *SMTP {
+	s.ifaces = append(s.ifaces, ifaces...)
+	return s
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+func familyName(ip net.IP) string {
+	if isIPv4(ip) {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// ifaceFor интерфейс того же семейства, что и ip, основной интерфейс в приоритете.
+// Интерфейс без IP подходит к любому адресу
+func (s *SMTP) ifaceFor(ip net.IP) *Iface {
+	for _, iface := range append([]*Iface{s.iface}, s.ifaces...) {
+		if iface == nil {
+			continue
+		}
+		if iface.IP == nil || isIPv4(iface.IP) == isIPv4(ip) {
+			return iface
+		}
+	}
+	return nil
+}
+
+// orderIPs адреса по s.ipPreference
+func (s *SMTP) orderIPs(ips []net.IP) []net.IP {
+	ordered := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		switch {
+		case s.ipPreference == IPv4Only && !isIPv4(ip):
+		case s.ipPreference == IPv6Only && isIPv4(ip):
+		default:
+			ordered = append(ordered, ip)
+		}
+	}
+	if s.ipPreference == PreferIPv6 {
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return !isIPv4(ordered[i]) && isIPv4(ordered[j])
+		})
+	}
+	return ordered
+}
+
+// addressLiteral адрес из домена вида [192.0.2.1] или [IPv6:2001:db8::1]
+// https://tools.ietf.org/html/rfc5321#section-4.1.3
+func addressLiteral(domain string) (net.IP, bool, error) {
+	if !strings.HasPrefix(domain, "[") || !strings.HasSuffix(domain, "]") {
+		return nil, false, nil
+	}
+	literal := domain[1 : len(domain)-1]
+	v6 := false
+	if len(literal) > 5 && strings.EqualFold(literal[:5], "IPv6:") {
+		literal = literal[5:]
+		v6 = true
+	}
+	ip := net.ParseIP(literal)
+	if ip == nil || v6 == isIPv4(ip) {
+		return nil, true, fmt.Errorf("bad address literal %s", domain)
+	}
+	return ip, true, nil
+}
@@ -0,0 +1,92 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+)
+
+// https://tools.ietf.org/html/rfc5321#section-5.1
+// https://tools.ietf.org/html/rfc7505
+
+// ErrNullMX домен объявил, что почту не принимает
+var ErrNullMX = errors.New("domain does not accept mail (null MX)")
+
+// Attempt неудачная попытка подключения к одному адресу MX сервера
+type Attempt struct {
+	// Host имя MX сервера
+	Host string
+	// IP адрес, к которому подключались, nil если не удалось получить адреса Host
+	IP  net.IP
+	Err error
+}
+
+func (a Attempt) String() string {
+	if a.IP == nil {
+		return fmt.Sprintf("%s: %s", a.Host, a.Err)
+	}
+	return fmt.Sprintf("%s [%s]: %s", a.Host, a.IP, a.Err)
+}
+
+// ConnectError ни к одному MX серверу домена подключиться не удалось, Attempts в порядке попыток
+type ConnectError struct {
+	Domain   string
+	Attempts []Attempt
+}
+
+func (e *ConnectError) Error() string {
+	attempts := make([]string, len(e.Attempts))
+	for i := range e.Attempts {
+		attempts[i] = e.Attempts[i].String()
+	}
+	return fmt.Sprintf("can not connect to %s, attempts: %s", e.Domain, strings.Join(attempts, "; "))
+}
+
+// Unwrap ошибки всех попыток, чтобы работали errors.Is и errors.As
+func (e *ConnectError) Unwrap() []error {
+	errs := make([]error, len(e.Attempts))
+	for i := range e.Attempts {
+		errs[i] = e.Attempts[i].Err
+	}
+	return errs
+}
+
+// lookupMX MX серверы домена в порядке, в котором к ним надо подключаться:
+// по предпочтению, а с одинаковым предпочтением в случайном порядке.
+// Если MX записей нет, то MX это сам домен
+func lookupMX(resolver Resolver, domain string) ([]*net.MX, error) {
+	mxs, err := resolver.LookupMX(context.Background(), domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return []*net.MX{{Host: domain}}, nil
+		}
+		return nil, err
+	}
+	if len(mxs) == 0 {
+		return []*net.MX{{Host: domain}}, nil
+	}
+	// Null MX должен быть единственной записью, рядом с другими его пропускаем.
+	// Записи копируются, resolver может вернуть свой срез, а он ниже перемешивается
+	hosts := make([]*net.MX, 0, len(mxs))
+	for i := range mxs {
+		if mxs[i].Host != "." && mxs[i].Host != "" {
+			hosts = append(hosts, mxs[i])
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, ErrNullMX
+	}
+	mxs = hosts
+	rand.Shuffle(len(mxs), func(i, j int) {
+		mxs[i], mxs[j] = mxs[j], mxs[i]
+	})
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	return mxs, nil
+}
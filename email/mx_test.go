@@ -0,0 +1,173 @@
+package email
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testResolver() *MapResolver {
+	return &MapResolver{
+		MX: map[string][]*net.MX{
+			"domain.tld": {
+				{Host: "mx3.domain.tld.", Pref: 30},
+				{Host: "mx1.domain.tld.", Pref: 10},
+				{Host: "mx2a.domain.tld.", Pref: 20},
+				{Host: "mx2b.domain.tld.", Pref: 20},
+			},
+			"null.tld":   {{Host: ".", Pref: 0}},
+			"alias.tld":  {{Host: "MX1.domain.tld", Pref: 5}, {Host: "mx2a.domain.tld", Pref: 5}, {Host: "mx2b.domain.tld.", Pref: 5}, {Host: "mx3.domain.tld.", Pref: 5}},
+			"other.tld":  {{Host: "mx.other.tld.", Pref: 10}},
+			"v4only.tld": {{Host: "mx.v4only.tld.", Pref: 10}},
+		},
+		IP: map[string][]net.IP{
+			"mx.v4only.tld": {net.ParseIP("192.0.2.25")},
+		},
+	}
+}
+
+func mxHosts(mxs []*net.MX) []string {
+	hosts := make([]string, len(mxs))
+	for i := range mxs {
+		hosts[i] = mxs[i].Host
+	}
+	return hosts
+}
+
+func TestLookupMXOrder(t *testing.T) {
+	resolver := testResolver()
+	for i := 0; i < 20; i++ {
+		mxs, err := lookupMX(resolver, "domain.tld")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts := mxHosts(mxs)
+		if hosts[0] != "mx1.domain.tld." || hosts[3] != "mx3.domain.tld." {
+			t.Fatalf("bad MX order %v", hosts)
+		}
+		// С одинаковым предпочтением порядок любой
+		middle := hosts[1] + " " + hosts[2]
+		if middle != "mx2a.domain.tld. mx2b.domain.tld." && middle != "mx2b.domain.tld. mx2a.domain.tld." {
+			t.Fatalf("bad MX order %v", hosts)
+		}
+	}
+	// Записи в MapResolver не должны меняться от перемешивания
+	if hosts := mxHosts(resolver.MX["domain.tld"]); hosts[0] != "mx3.domain.tld." || hosts[1] != "mx1.domain.tld." {
+		t.Fatalf("resolver records changed %v", hosts)
+	}
+}
+
+func TestLookupMXNull(t *testing.T) {
+	if _, err := lookupMX(testResolver(), "null.tld"); !errors.Is(err, ErrNullMX) {
+		t.Fatalf("expected ErrNullMX, got %v", err)
+	}
+	// Null MX рядом с обычными записями пропускается
+	resolver := testResolver()
+	resolver.MX["mixed.tld"] = []*net.MX{{Host: ".", Pref: 0}, {Host: "mx.mixed.tld.", Pref: 10}}
+	mxs, err := lookupMX(resolver, "mixed.tld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hosts := mxHosts(mxs); !reflect.DeepEqual(hosts, []string{"mx.mixed.tld."}) {
+		t.Fatalf("bad MX %v", hosts)
+	}
+}
+
+func TestLookupMXImplicit(t *testing.T) {
+	mxs, err := lookupMX(testResolver(), "nomx.tld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hosts := mxHosts(mxs); !reflect.DeepEqual(hosts, []string{"nomx.tld"}) {
+		t.Fatalf("expected implicit MX, got %v", hosts)
+	}
+}
+
+func TestOrderIPs(t *testing.T) {
+	v4a, v6a := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	v4b, v6b := net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::2")
+	ips := []net.IP{v4a, v6a, v4b, v6b}
+	tests := []struct {
+		preference IPPreference
+		expected   []net.IP
+	}{
+		{IPAny, []net.IP{v4a, v6a, v4b, v6b}},
+		{IPv4Only, []net.IP{v4a, v4b}},
+		{IPv6Only, []net.IP{v6a, v6b}},
+		{PreferIPv6, []net.IP{v6a, v6b, v4a, v4b}},
+	}
+	for _, test := range tests {
+		s := NewSmtp(&Iface{IP: net.ParseIP("192.0.2.100")}).SetIPPreference(test.preference)
+		if ordered := s.orderIPs(ips); !reflect.DeepEqual(ordered, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.preference, test.expected, ordered)
+		}
+	}
+}
+
+func TestIfaceFor(t *testing.T) {
+	v4 := &Iface{IP: net.ParseIP("192.0.2.100"), Hostname: "v4.local"}
+	v6 := &Iface{IP: net.ParseIP("2001:db8::100"), Hostname: "v6.local"}
+	s := NewSmtp(v4).AddIface(v6)
+	if iface := s.ifaceFor(net.ParseIP("192.0.2.25")); iface != v4 {
+		t.Errorf("expected v4 interface, got %v", iface)
+	}
+	if iface := s.ifaceFor(net.ParseIP("2001:db8::25")); iface != v6 {
+		t.Errorf("expected v6 interface, got %v", iface)
+	}
+	if iface := NewSmtp(v4).ifaceFor(net.ParseIP("2001:db8::25")); iface != nil {
+		t.Errorf("expected no interface, got %v", iface)
+	}
+}
+
+func TestConnectIPPreference(t *testing.T) {
+	// К MX только с IPv4 адресом при IPv6Only не подключаемся вовсе, сеть не нужна
+	s := NewSmtp(&Iface{IP: net.ParseIP("2001:db8::100")}).
+		SetResolver(testResolver()).
+		SetIPPreference(IPv6Only)
+	err := s.CommandConnectAndHello("user@v4only.tld")
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) {
+		t.Fatalf("expected ConnectError, got %v", err)
+	}
+	if len(connectErr.Attempts) != 1 || connectErr.Attempts[0].Host != "mx.v4only.tld" ||
+		!strings.Contains(connectErr.Attempts[0].Err.Error(), "IP preference") {
+		t.Fatalf("bad attempts %v", connectErr.Attempts)
+	}
+}
+
+func TestPlanDeliveryResolver(t *testing.T) {
+	envelopes := []Envelope{
+		{From: "a@sender.tld", To: "1@domain.tld"},
+		{From: "a@sender.tld", To: "2@other.tld"},
+		{From: "a@sender.tld", To: "3@alias.tld"},
+		{From: "b@sender.tld", To: "4@domain.tld"},
+		{From: "a@sender.tld", To: "5@Domain.tld"},
+		{From: "a@sender.tld", To: "6@nomx.tld"},
+	}
+	expected := []Group{
+		{Domain: "domain.tld", From: "a@sender.tld", To: []string{"1@domain.tld", "3@alias.tld", "5@Domain.tld"}},
+		{Domain: "other.tld", From: "a@sender.tld", To: []string{"2@other.tld"}},
+		{Domain: "domain.tld", From: "b@sender.tld", To: []string{"4@domain.tld"}},
+		{Domain: "nomx.tld", From: "a@sender.tld", To: []string{"6@nomx.tld"}},
+	}
+	if groups := PlanDeliveryResolver(envelopes, testResolver()); !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, groups)
+	}
+	// Без resolver alias.tld отдельная группа
+	if groups := PlanDelivery(envelopes); len(groups) != 5 {
+		t.Fatalf("expected 5 groups, got %+v", groups)
+	}
+}
+
+func TestPlanDeliveryMaxRecipients(t *testing.T) {
+	var envelopes []Envelope
+	for i := 0; i < maxGroupRecipients+1; i++ {
+		envelopes = append(envelopes, Envelope{From: "a@sender.tld", To: "user@domain.tld"})
+	}
+	groups := PlanDelivery(envelopes)
+	if len(groups) != 2 || len(groups[0].To) != maxGroupRecipients || len(groups[1].To) != 1 {
+		t.Fatalf("bad groups %d", len(groups))
+	}
+}
@@ -0,0 +1,127 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// https://tools.ietf.org/html/rfc2920
+
+// Pipelining сервер объявил PIPELINING и команды конверта можно отправлять не дожидаясь ответов
+func (s *SMTP) Pipelining() bool {
+	ok, _ := s.client.Extension("PIPELINING")
+	return ok
+}
+
+// ErrBadLine в адресе есть CR или LF, такую команду отправить нельзя, соединение при этом остаётся рабочим
+var ErrBadLine = errors.New("smtp: A line must not contain CR or LF")
+
+// ErrMessageTooBig письмо больше, чем сервер объявил в SIZE, оно не отправляется, соединение остаётся рабочим
+var ErrMessageTooBig = errors.New("smtp: message size exceeds server limit")
+
+// CommandFromRcpt MAIL FROM как CommandFromSize и RCPT TO для всех to. Если сервер поддерживает PIPELINING,
+// то все команды уходят одним пакетом, а ответы читаются по порядку, иначе каждая команда ждёт своего ответа.
+// Возвращает ошибку для каждого получателя, если MAIL FROM не прошёл, то у всех получателей его ошибка.
+// Получатель с CR или LF в адресе не отправляется и получает ErrBadLine, остальным письмо отправляется
+func (s *SMTP) CommandFromRcpt(from string, size int64, to []string) []error {
+	errs := make([]error, len(to))
+	for i := range to {
+		if strings.ContainsAny(to[i], "\r\n") {
+			errs[i] = ErrBadLine
+		}
+	}
+	if !s.Pipelining() {
+		if err := s.CommandFromSize(from, size); err != nil {
+			return fillErrors(errs, err)
+		}
+		for i := range to {
+			if errs[i] == nil {
+				errs[i] = s.CommandRcpt(to[i])
+			}
+		}
+		return errs
+	}
+
+	mail, err := s.mailCommand(from, size)
+	if err != nil {
+		s.traceCommand("MAIL FROM", from, err)
+		return fillErrors(errs, err)
+	}
+	commands := []string{mail}
+	for i := range to {
+		if errs[i] == nil {
+			commands = append(commands, fmt.Sprintf("RCPT TO:<%s>", to[i]))
+		}
+	}
+	if err = s.pipelineWrite(commands); err != nil {
+		return fillErrors(errs, err)
+	}
+
+	// Ответы приходят в порядке команд, читаем все, даже если MAIL FROM отклонён, иначе собьётся очередь ответов
+	mailErr := s.pipelineRead("MAIL FROM", 250)
+	s.traceCommand("MAIL FROM", from, mailErr)
+	for i := range to {
+		if errs[i] != nil {
+			continue
+		}
+		errs[i] = s.pipelineRead("RCPT TO", 25)
+		s.traceCommand("RCPT TO", to[i], errs[i])
+		if mailErr != nil && (errs[i] == nil || isReplyError(errs[i])) {
+			errs[i] = mailErr
+		}
+	}
+	if mailErr != nil && !isReplyError(mailErr) {
+		return fillErrors(errs, mailErr)
+	}
+	return errs
+}
+
+// mailCommand строка MAIL FROM: параметры SIZE, BODY=8BITMIME и SMTPUTF8 добавляются независимо,
+// каждый, если сервер объявил соответствующее расширение, как в smtp.Client.Mail
+func (s *SMTP) mailCommand(email string, size int64) (string, error) {
+	if strings.ContainsAny(email, "\r\n") {
+		return "", ErrBadLine
+	}
+	command := fmt.Sprintf("MAIL FROM:<%s>", email)
+	if ok, _ := s.client.Extension("SIZE"); ok {
+		if maxSize := s.MaxSize(); maxSize > 0 && size > maxSize {
+			return "", fmt.Errorf("%w: %d > %d", ErrMessageTooBig, size, maxSize)
+		}
+		command += fmt.Sprintf(" SIZE=%d", size)
+	}
+	if ok, _ := s.client.Extension("8BITMIME"); ok {
+		command += " BODY=8BITMIME"
+	}
+	if ok, _ := s.client.Extension("SMTPUTF8"); ok {
+		command += " SMTPUTF8"
+	}
+	return command, nil
+}
+
+// pipelineWrite пишет команды в соединение одним пакетом, без ожидания ответов
+func (s *SMTP) pipelineWrite(commands []string) error {
+	w := s.client.Text.W
+	for i := range commands {
+		if _, err := w.WriteString(commands[i] + "\r\n"); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// pipelineRead читает ответ на очередную команду пакета
+func (s *SMTP) pipelineRead(command string, expectCode int) error {
+	_, _, err := s.client.Text.ReadResponse(expectCode)
+	return replyError(command, err)
+}
+
+// fillErrors err для всех получателей, у которых ещё нет ошибки
+func fillErrors(errs []error, err error) []error {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
@@ -0,0 +1,116 @@
+package email
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// rejectServer сервер, который отклоняет RCPT TO на адреса bad* и temp*, а с rejectMail и MAIL FROM
+func rejectServer(t *testing.T, rejectMail bool, ehlo ...string) *fakeServer {
+	server := newFakeServer(t, ehlo...)
+	server.reply = func(command string) string {
+		switch {
+		case rejectMail && strings.HasPrefix(command, "MAIL FROM:"):
+			return "550 5.7.1 sender rejected"
+		case strings.HasPrefix(command, "RCPT TO:<bad"):
+			return "550 5.1.1 no such user"
+		case strings.HasPrefix(command, "RCPT TO:<temp"):
+			return "450 4.2.1 try later"
+		}
+		return ""
+	}
+	return server
+}
+
+func replyCode(err error) int {
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Code
+	}
+	return 0
+}
+
+func TestCommandFromRcpt(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		var ehlo []string
+		if pipelining {
+			ehlo = []string{"PIPELINING"}
+		}
+		server := rejectServer(t, false, ehlo...)
+		s := server.client()
+		if err := s.CommandConnectAndHello("user@domain.tld"); err != nil {
+			t.Fatal(err)
+		}
+		if s.Pipelining() != pipelining {
+			t.Fatalf("expected pipelining %v", pipelining)
+		}
+		to := []string{"1@domain.tld", "bad@domain.tld", "temp@domain.tld", "cr\r\n@domain.tld", "2@domain.tld"}
+		errs := s.CommandFromRcpt("a@sender.tld", 5, to)
+		codes := []int{0, 550, 450, 0, 0}
+		for i := range to {
+			if replyCode(errs[i]) != codes[i] {
+				t.Errorf("pipelining %v, %q: expected %d, got %v", pipelining, to[i], codes[i], errs[i])
+			}
+		}
+		if !errors.Is(errs[3], ErrBadLine) || errs[0] != nil || errs[4] != nil {
+			t.Errorf("pipelining %v: bad errors %v", pipelining, errs)
+		}
+		// Адрес с CR или LF на сервер не уходит, ответы остальным не сбиты
+		for _, command := range server.log() {
+			if strings.Contains(command, "cr") {
+				t.Errorf("pipelining %v: server got %q", pipelining, command)
+			}
+		}
+		if err := s.CommandData([]byte("hello")); err != nil {
+			t.Fatalf("pipelining %v: %v", pipelining, err)
+		}
+		s.CommandQuit()
+	}
+}
+
+func TestCommandFromRcptMailRejected(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		var ehlo []string
+		if pipelining {
+			ehlo = []string{"PIPELINING"}
+		}
+		server := rejectServer(t, true, ehlo...)
+		s := server.client()
+		if err := s.CommandConnectAndHello("user@domain.tld"); err != nil {
+			t.Fatal(err)
+		}
+		for i, err := range s.CommandFromRcpt("a@sender.tld", 5, []string{"1@domain.tld", "bad@domain.tld"}) {
+			var replyErr *ReplyError
+			if !errors.As(err, &replyErr) || replyErr.Command != "MAIL FROM" || replyErr.Code != 550 {
+				t.Errorf("pipelining %v, %d: expected MAIL FROM rejection, got %v", pipelining, i, err)
+			}
+		}
+		// Ответы на RCPT TO прочитаны, следующая команда получает свой ответ
+		if err := s.CommandReset(); err != nil {
+			t.Fatalf("pipelining %v: %v", pipelining, err)
+		}
+		if err := s.CommandNoop(); err != nil {
+			t.Fatalf("pipelining %v: %v", pipelining, err)
+		}
+		s.CommandQuit()
+	}
+}
+
+func TestMailCommand(t *testing.T) {
+	server := newFakeServer(t, "SIZE 10", "8BITMIME", "SMTPUTF8")
+	s := server.client()
+	if err := s.CommandConnectAndHello("user@domain.tld"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.CommandQuit()
+	if command, err := s.mailCommand("a@sender.tld", 5); err != nil || command != "MAIL FROM:<a@sender.tld> SIZE=5 BODY=8BITMIME SMTPUTF8" {
+		t.Fatalf("bad command %q %v", command, err)
+	}
+	if _, err := s.mailCommand("a@sender.tld", 11); !errors.Is(err, ErrMessageTooBig) {
+		t.Fatalf("expected ErrMessageTooBig, got %v", err)
+	}
+	if _, err := s.mailCommand("a@sender.tld\r\n", 5); !errors.Is(err, ErrBadLine) {
+		t.Fatalf("expected ErrBadLine, got %v", err)
+	}
+}
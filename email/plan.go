@@ -0,0 +1,171 @@
+package email
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+)
+
+// maxGroupRecipients столько RCPT в одной транзакции сервер обязан принять
+// https://tools.ietf.org/html/rfc5321#section-4.5.3.1.8
+const maxGroupRecipients = 100
+
+// Envelope отправитель и получатель конверта
+type Envelope struct {
+	From string
+	To   string
+}
+
+// Group получатели, которым письмо уходит одной транзакцией MAIL, RCPT..., DATA
+type Group struct {
+	// Domain домен, к MX которого подключаться
+	Domain string
+	From   string
+	To     []string
+}
+
+// Result итог доставки одному получателю, Err nil если сервер принял письмо
+type Result struct {
+	To  string
+	Err error
+}
+
+// PlanDelivery группирует получателей по домену и отправителю конверта,
+// с VERP у каждого получателя свой отправитель и группы будут по одному получателю.
+// Порядок групп и получателей в них как в envelopes
+func PlanDelivery(envelopes []Envelope) []Group {
+	return plan(envelopes, func(domain string) string {
+		return strings.ToLower(domain)
+	})
+}
+
+// PlanDeliveryResolver как PlanDelivery, но домены с одинаковыми MX серверами попадают в одну группу,
+// например домены одного почтового хостинга
+func PlanDeliveryResolver(envelopes []Envelope, resolver Resolver) []Group {
+	keys := map[string]string{}
+	return plan(envelopes, func(domain string) string {
+		domain = strings.ToLower(domain)
+		if key, ok := keys[domain]; ok {
+			return key
+		}
+		keys[domain] = mxKey(resolver, domain)
+		return keys[domain]
+	})
+}
+
+// mxKey список MX серверов домена, если их не удалось получить, то сам домен
+func mxKey(resolver Resolver, domain string) string {
+	if _, ok, _ := addressLiteral(domain); ok {
+		return domain
+	}
+	mxs, err := resolver.LookupMX(context.Background(), domain)
+	if err != nil || len(mxs) == 0 {
+		return domain
+	}
+	hosts := make([]string, len(mxs))
+	for i := range mxs {
+		hosts[i] = strings.ToLower(strings.TrimSuffix(mxs[i].Host, "."))
+	}
+	sort.Strings(hosts)
+	return "mx:" + strings.Join(hosts, ",")
+}
+
+func plan(envelopes []Envelope, key func(domain string) string) []Group {
+	var groups []Group
+	index := map[[2]string]int{}
+	for _, e := range envelopes {
+		domain := ""
+		if i := strings.LastIndex(e.To, "@"); i > 0 {
+			domain = e.To[i+1:]
+		}
+		k := [2]string{key(domain), e.From}
+		i, ok := index[k]
+		if !ok || len(groups[i].To) >= maxGroupRecipients {
+			groups = append(groups, Group{Domain: domain, From: e.From})
+			i = len(groups) - 1
+			index[k] = i
+		}
+		groups[i].To = append(groups[i].To, e.To)
+	}
+	return groups
+}
+
+// Deliver подключается к MX домена группы и отправляет письмо всем получателям группы одной транзакцией.
+// Если сервер отклонил часть получателей, то письмо получат остальные, результат для каждого получателя
+func (s *SMTP) Deliver(g Group, size int64, data io.Reader) []Result {
+	results := groupResults(g)
+	if len(g.To) == 0 {
+		return results
+	}
+	if err := s.CommandConnectAndHello(g.To[0]); err != nil {
+		return failResults(results, err)
+	}
+	defer s.CommandClose()
+	if err := s.CommandAuth(); err != nil {
+		return failResults(results, err)
+	}
+	s.transaction(g, size, data, results)
+	s.CommandQuit()
+	return results
+}
+
+func groupResults(g Group) []Result {
+	results := make([]Result, len(g.To))
+	for i := range g.To {
+		results[i].To = g.To[i]
+	}
+	return results
+}
+
+// failResults err для всех получателей, у которых ещё нет ошибки
+func failResults(results []Result, err error) []Result {
+	for i := range results {
+		if results[i].Err == nil {
+			results[i].Err = err
+		}
+	}
+	return results
+}
+
+// transaction MAIL, RCPT..., DATA на открытом соединении, с PIPELINING команды конверта уходят одним пакетом.
+// Результаты пишутся в results.
+// Возвращает ошибку, на которой транзакция прервалась, если это connectionError, то соединение использовать нельзя
+func (s *SMTP) transaction(g Group, size int64, data io.Reader, results []Result) error {
+	var rcptErr error
+	for i, err := range s.CommandFromRcpt(g.From, size, g.To) {
+		if results[i].Err = err; err != nil {
+			rcptErr = err
+		}
+	}
+	for i := range results {
+		if connectionError(results[i].Err) {
+			failResults(results, results[i].Err)
+			return results[i].Err
+		}
+	}
+	accepted := 0
+	for i := range results {
+		if results[i].Err == nil {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		return rcptErr
+	}
+	w, err := s.CommandDataWriter()
+	if err != nil {
+		failResults(results, err)
+		return err
+	}
+	if _, err = io.Copy(w, data); err != nil {
+		failResults(results, err)
+		return err
+	}
+	// Ответ на конец DATA один на всех принятых получателей
+	if err = w.Close(); err != nil {
+		failResults(results, err)
+		return err
+	}
+	return nil
+}
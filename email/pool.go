@@ -0,0 +1,228 @@
+package email
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIdleTimeout = 30 * time.Second
+	defaultMaxMessages = 100
+)
+
+// Pool открытые соединения по MX серверу и локальному интерфейсу, чтобы не тратить
+// на каждое письмо подключение, EHLO и TLS
+type Pool struct {
+	// New настроенный клиент для нового соединения: интерфейсы, TLS, Relay
+	New func() *SMTP
+	// IdleTimeout сколько соединение может простаивать в пуле, серверы обычно закрывают его через несколько минут
+	IdleTimeout time.Duration
+	// MaxMessages сколько писем отправлять через одно соединение, 0 без ограничения
+	MaxMessages int
+
+	mu   sync.Mutex
+	idle []idleConn
+	// timer закрывает простаивающие соединения, даже если пулом никто не пользуется
+	timer *time.Timer
+}
+
+type idleConn struct {
+	s     *SMTP
+	since time.Time
+}
+
+// NewPool пул соединений клиентов, которые создаёт newSMTP
+func NewPool(newSMTP func() *SMTP) *Pool {
+	return &Pool{
+		New:         newSMTP,
+		IdleTimeout: defaultIdleTimeout,
+		MaxMessages: defaultMaxMessages,
+	}
+}
+
+// Get соединение с MX сервером домена получателя to: свободное из пула, если оно живо, или новое.
+// После транзакции соединение надо вернуть через Put или закрыть через Discard
+func (p *Pool) Get(to string) (*SMTP, error) {
+	s := p.New()
+	// С пустым пулом MX не ищем, их всё равно найдёт CommandConnectAndHello
+	if i := strings.LastIndex(to, "@"); i > 0 && p.idleCount() > 0 {
+		hosts := s.poolHosts(to[i+1:])
+		for {
+			pooled := p.take(hosts, append([]*Iface{s.iface}, s.ifaces...))
+			if pooled == nil {
+				break
+			}
+			if err := pooled.CommandNoop(); err == nil {
+				return pooled, nil
+			}
+			pooled.CommandClose()
+		}
+	}
+	if err := s.CommandConnectAndHello(to); err != nil {
+		return nil, err
+	}
+	if err := s.CommandAuth(); err != nil {
+		s.CommandClose()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Put возвращает соединение в пул после транзакции. Если лимит писем исчерпан или RSET не прошёл, соединение закрывается
+func (p *Pool) Put(s *SMTP) {
+	if p.MaxMessages > 0 && s.messages >= p.MaxMessages {
+		s.CommandQuit()
+		s.CommandClose()
+		return
+	}
+	if err := s.CommandReset(); err != nil {
+		s.CommandClose()
+		return
+	}
+	p.mu.Lock()
+	p.idle = append(p.idle, idleConn{s: s, since: time.Now()})
+	p.schedule()
+	p.mu.Unlock()
+}
+
+// Discard закрывает соединение, которое нельзя использовать дальше, например после обрыва посреди DATA
+func (p *Pool) Discard(s *SMTP) {
+	s.CommandClose()
+}
+
+// Close закрывает все свободные соединения
+func (p *Pool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.mu.Unlock()
+	for i := range idle {
+		idle[i].s.CommandQuit()
+		idle[i].s.CommandClose()
+	}
+}
+
+// Deliver как SMTP.Deliver, но через соединение из пула
+func (p *Pool) Deliver(g Group, size int64, data io.Reader) []Result {
+	results := groupResults(g)
+	if len(g.To) == 0 {
+		return results
+	}
+	s, err := p.Get(g.To[0])
+	if err != nil {
+		return failResults(results, err)
+	}
+	if err = s.transaction(g, size, data, results); connectionError(err) {
+		p.Discard(s)
+	} else {
+		p.Put(s)
+	}
+	return results
+}
+
+// take последнее использованное свободное соединение к одному из hosts через один из ifaces
+func (p *Pool) take(hosts []string, ifaces []*Iface) *SMTP {
+	p.closeExpired()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := len(p.idle) - 1; i >= 0; i-- {
+		s := p.idle[i].s
+		if !containsHost(hosts, s.connHost) || !containsIface(ifaces, s.connIface) {
+			continue
+		}
+		p.idle = append(p.idle[:i], p.idle[i+1:]...)
+		return s
+	}
+	return nil
+}
+
+// closeExpired закрывает соединения, простоявшие дольше IdleTimeout
+func (p *Pool) closeExpired() {
+	var expired []*SMTP
+	p.mu.Lock()
+	idle := p.idle[:0]
+	for i := range p.idle {
+		if p.IdleTimeout > 0 && time.Since(p.idle[i].since) > p.IdleTimeout {
+			expired = append(expired, p.idle[i].s)
+			continue
+		}
+		idle = append(idle, p.idle[i])
+	}
+	p.idle = idle
+	p.schedule()
+	p.mu.Unlock()
+	for _, s := range expired {
+		s.CommandQuit()
+		s.CommandClose()
+	}
+}
+
+func (p *Pool) idleCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// schedule заводит таймер на момент, когда истечёт самое старое свободное соединение, вызывается под p.mu
+func (p *Pool) schedule() {
+	if p.timer != nil || len(p.idle) == 0 || p.IdleTimeout <= 0 {
+		return
+	}
+	// Соединения добавляются в конец, самое старое первое
+	wait := p.IdleTimeout - time.Since(p.idle[0].since)
+	if wait < 0 {
+		wait = 0
+	}
+	p.timer = time.AfterFunc(wait+time.Millisecond, func() {
+		p.mu.Lock()
+		p.timer = nil
+		p.mu.Unlock()
+		p.closeExpired()
+	})
+}
+
+// poolHosts к каким серверам может подключиться s для домена: Relay, адрес из address literal или MX серверы
+func (s *SMTP) poolHosts(domain string) []string {
+	if s.relay != nil {
+		return []string{s.relay.Addr}
+	}
+	if ip, ok, _ := addressLiteral(domain); ok {
+		if ip == nil {
+			return nil
+		}
+		return []string{ip.String()}
+	}
+	mxs, err := lookupMX(s.resolver, domain)
+	if err != nil {
+		return nil
+	}
+	hosts := make([]string, len(mxs))
+	for i := range mxs {
+		hosts[i] = strings.TrimSuffix(mxs[i].Host, ".")
+	}
+	return hosts
+}
+
+func containsHost(hosts []string, host string) bool {
+	for i := range hosts {
+		if strings.EqualFold(hosts[i], host) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIface(ifaces []*Iface, iface *Iface) bool {
+	for i := range ifaces {
+		if ifaces[i] == iface || ifaces[i] != nil && iface != nil && ifaces[i].IP.Equal(iface.IP) && ifaces[i].Hostname == iface.Hostname {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package email
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func count(commands []string, command string) int {
+	n := 0
+	for i := range commands {
+		if commands[i] == command {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPoolReuse(t *testing.T) {
+	server := newFakeServer(t, "PIPELINING")
+	pool := NewPool(server.client)
+	g := Group{Domain: "domain.tld", From: "a@sender.tld", To: []string{"1@domain.tld"}}
+	for i := 0; i < 3; i++ {
+		for _, res := range pool.Deliver(g, 5, strings.NewReader("hello")) {
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+		}
+	}
+	pool.Close()
+	log := server.log()
+	// Одно подключение, после каждого письма RSET, перед следующим NOOP
+	if count(log, "CONNECT") != 1 || count(log, "RSET") != 3 || count(log, "NOOP") != 2 || count(log, "QUIT") != 1 {
+		t.Fatalf("bad session %q", log)
+	}
+}
+
+func TestPoolMaxMessages(t *testing.T) {
+	server := newFakeServer(t)
+	pool := NewPool(server.client)
+	pool.MaxMessages = 2
+	g := Group{Domain: "domain.tld", From: "a@sender.tld", To: []string{"1@domain.tld"}}
+	for i := 0; i < 3; i++ {
+		pool.Deliver(g, 5, strings.NewReader("hello"))
+	}
+	pool.Close()
+	log := server.log()
+	// После двух писем соединение закрывается, третье идёт через новое
+	if count(log, "CONNECT") != 2 || count(log, "QUIT") != 2 {
+		t.Fatalf("bad session %q", log)
+	}
+}
+
+func TestPoolRejected(t *testing.T) {
+	server := rejectServer(t, false, "PIPELINING")
+	pool := NewPool(server.client)
+	// Отказ сервера не повод закрывать соединение
+	g := Group{Domain: "domain.tld", From: "a@sender.tld", To: []string{"bad@domain.tld"}}
+	if results := pool.Deliver(g, 5, strings.NewReader("hello")); replyCode(results[0].Err) != 550 {
+		t.Fatalf("expected 550, got %v", results[0].Err)
+	}
+	g.To = []string{"1@domain.tld", "cr\r\n@domain.tld"}
+	results := pool.Deliver(g, 5, strings.NewReader("hello"))
+	if results[0].Err != nil || !errors.Is(results[1].Err, ErrBadLine) {
+		t.Fatalf("bad results %+v", results)
+	}
+	pool.Close()
+	if log := server.log(); count(log, "CONNECT") != 1 || count(log, "DATA hello") != 1 {
+		t.Fatalf("bad session %q", log)
+	}
+}
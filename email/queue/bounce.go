@@ -0,0 +1,120 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/supme/handSendEmail/email"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// https://tools.ietf.org/html/rfc3464
+// https://tools.ietf.org/html/rfc6522
+
+const boundaryBounce = "_bounce_delivery_status_"
+
+// addBounce ставит в очередь уведомление о недоставке (DSN) отправителю конверта r
+// с пустым отправителем, чтобы на само уведомление не пришло уведомление
+func (q *Queue) addBounce(e Entry, r Recipient) (string, error) {
+	to := r.envelopeFrom(e)
+	if to == "" {
+		// Не доставлено само уведомление
+		return "", nil
+	}
+	headers, err := q.originalHeaders(e.ID)
+	if err != nil {
+		return "", err
+	}
+	now := q.now()
+	status := r.DSNStatus
+	if status == "" {
+		status = "5.0.0"
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", q.ReportingMTA)
+	fmt.Fprintf(&b, "To: <%s>\r\n", to)
+	fmt.Fprintf(&b, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n\r\n", boundaryBounce)
+
+	fmt.Fprintf(&b, "--%s\r\n", boundaryBounce)
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "Your message could not be delivered to <%s>.\r\n\r\n%s\r\n", r.Address, oneLine(r.LastError))
+
+	fmt.Fprintf(&b, "--%s\r\n", boundaryBounce)
+	fmt.Fprintf(&b, "Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", q.ReportingMTA)
+	fmt.Fprintf(&b, "Arrival-Date: %s\r\n\r\n", e.Created.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", r.Address)
+	fmt.Fprintf(&b, "Action: failed\r\n")
+	fmt.Fprintf(&b, "Status: %s\r\n", status)
+	fmt.Fprintf(&b, "Diagnostic-Code: smtp; %s\r\n", oneLine(r.LastError))
+	fmt.Fprintf(&b, "Last-Attempt-Date: %s\r\n\r\n", now.Format(time.RFC1123Z))
+
+	fmt.Fprintf(&b, "--%s\r\n", boundaryBounce)
+	fmt.Fprintf(&b, "Content-Type: text/rfc822-headers\r\n\r\n")
+	b.Write(headers)
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundaryBounce)
+
+	return q.add("", Recipients(to), &b)
+}
+
+// originalHeaders заголовки письма из очереди без тела
+func (q *Queue) originalHeaders(id string) ([]byte, error) {
+	f, err := os.Open(q.path(id, messageExt))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var b bytes.Buffer
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "" {
+			break
+		}
+		b.WriteString(strings.TrimRight(line, "\r\n") + "\r\n")
+		if err != nil {
+			break
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// dsnStatus код для уведомления о недоставке по постоянной ошибке
+// https://tools.ietf.org/html/rfc3463
+func dsnStatus(err error) string {
+	var replyErr *email.ReplyError
+	if errors.As(err, &replyErr) && replyErr.Enhanced.Class == 5 {
+		return replyErr.Enhanced.String()
+	}
+	if errors.Is(err, email.ErrBadLine) {
+		// 5.1.3 неправильный адрес
+		return "5.1.3"
+	}
+	if errors.Is(err, email.ErrMessageTooBig) {
+		// 5.3.4 письмо слишком большое для сервера
+		return "5.3.4"
+	}
+	if errors.Is(err, email.ErrNullMX) {
+		// 5.1.10 домен не принимает почту, RFC 7505
+		return "5.1.10"
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		// 5.1.2 нет такого домена
+		return "5.1.2"
+	}
+	return "5.0.0"
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,29 @@
+package queue
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockName файл блокировки очереди, его держит процесс, который сейчас работает с очередью
+const lockName = "lock"
+
+// lock блокирует очередь для других процессов, других Queue на той же папке и других горутин, ждёт, если она занята
+func (q *Queue) lock() (unlock func(), err error) {
+	q.mu.Lock()
+	f, err := os.OpenFile(filepath.Join(q.dir, lockName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		q.mu.Unlock()
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		q.mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+		q.mu.Unlock()
+	}, nil
+}
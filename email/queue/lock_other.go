@@ -0,0 +1,34 @@
+//go:build !unix
+
+package queue
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Без flock блокировка это отдельный файл, созданный с O_EXCL, ждём его удаления не дольше lockWait
+const lockWait = time.Minute
+
+func lockFile(f *os.File) error {
+	name := f.Name() + ".pid"
+	for start := time.Now(); ; {
+		pid, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(pid, "%d\n", os.Getpid())
+			return pid.Close()
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if time.Since(start) > lockWait {
+			return fmt.Errorf("queue is locked by another process, remove %s if it is not running", name)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func unlockFile(f *os.File) error {
+	return os.Remove(f.Name() + ".pid")
+}
@@ -0,0 +1,535 @@
+// Package queue очередь исходящих писем на диске с повторами временных ошибок
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/supme/handSendEmail/email"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinDelay = time.Minute
+	defaultMaxDelay = 4 * time.Hour
+	defaultJitter   = 0.2
+	defaultMaxAge   = 5 * 24 * time.Hour
+
+	entryExt   = ".json"
+	messageExt = ".eml"
+	tmpExt     = ".tmp"
+)
+
+// Status состояние доставки одному получателю
+type Status string
+
+const (
+	StatusQueued  Status = "queued"
+	StatusSent    Status = "sent"
+	StatusBounced Status = "bounced"
+)
+
+// Recipient получатель письма в очереди
+type Recipient struct {
+	Address string `json:"address"`
+	// From отправитель конверта для этого получателя, например VERP адрес, если пусто, то Entry.From
+	From        string    `json:"from,omitempty"`
+	Status      Status    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	// DSNStatus код для уведомления о недоставке, например 5.1.1 или 4.4.7, если истёк MaxAge
+	DSNStatus string `json:"dsn_status,omitempty"`
+	// Notice уведомление отправителю о недоставке ещё не поставлено в очередь
+	Notice bool `json:"notice,omitempty"`
+}
+
+func (r Recipient) envelopeFrom(e Entry) string {
+	if r.From != "" {
+		return r.From
+	}
+	return e.From
+}
+
+// Entry письмо в очереди, само письмо лежит рядом в файле ID.eml
+type Entry struct {
+	ID         string      `json:"id"`
+	From       string      `json:"from"`
+	Created    time.Time   `json:"created"`
+	Recipients []Recipient `json:"recipients"`
+}
+
+// done всем получателям письмо доставлено или возвращено и все уведомления о недоставке поставлены в очередь
+func (e Entry) done() bool {
+	for i := range e.Recipients {
+		if e.Recipients[i].Status == StatusQueued || e.Recipients[i].Notice {
+			return false
+		}
+	}
+	return true
+}
+
+// Result итог одной попытки доставки
+type Result struct {
+	ID        string
+	Recipient string
+	Status    Status
+	// Err ошибка попытки, для StatusQueued это временная ошибка и будет повтор
+	Err error
+}
+
+// Transport отправляет письмо группе получателей одной транзакцией и возвращает результат
+// для каждого получателя группы. Ошибки *email.ReplyError с кодом 5xx на MAIL FROM, RCPT TO и DATA
+// считаются постоянными, остальные временными
+type Transport interface {
+	Send(g email.Group, size int64, data io.Reader) []email.Result
+}
+
+// Queue очередь писем в папке, каждое письмо это два файла: ID.eml и состояние ID.json.
+// Состояние пишется после каждой попытки, так что очередь переживает перезапуск.
+// С одной папкой могут работать несколько процессов, папка блокируется только на время добавления письма
+// и записи состояния, но не на время отправки
+type Queue struct {
+	dir       string
+	transport Transport
+	// MinDelay задержка перед первым повтором, дальше удваивается до MaxDelay
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// Jitter доля случайного разброса задержки, чтобы повторы не шли все разом
+	Jitter float64
+	// MaxAge сколько письмо может провести в очереди, после этого временная ошибка считается постоянной
+	MaxAge time.Duration
+	// ReportingMTA имя этого сервера, обычно Iface.Hostname. Если задано, то на каждого
+	// получателя, которому письмо доставить не удалось, отправителю ставится в очередь уведомление (DSN)
+	ReportingMTA string
+	// Bounce вызывается для каждого получателя, которому письмо доставить не удалось,
+	// например чтобы исключить адрес из рассылки
+	Bounce func(e Entry, r Recipient)
+	// Resolver если задан, то получатели на разных доменах с одинаковыми MX серверами уходят одной транзакцией
+	Resolver email.Resolver
+	// Now текущее время, для проверки расписания без ожидания
+	Now func() time.Time
+
+	mu sync.Mutex
+}
+
+// Open открывает очередь в папке dir, создавая её при необходимости.
+// Недописанные файлы от прошлого запуска удаляются
+func Open(dir string, transport Transport) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		dir:       dir,
+		transport: transport,
+		MinDelay:  defaultMinDelay,
+		MaxDelay:  defaultMaxDelay,
+		Jitter:    defaultJitter,
+		MaxAge:    defaultMaxAge,
+	}
+	// Под блокировкой, иначе удалим файлы, которые сейчас пишет другой процесс
+	unlock, err := q.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	tmps, err := filepath.Glob(filepath.Join(dir, "*"+tmpExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
+	return q, nil
+}
+
+func (q *Queue) now() time.Time {
+	if q.Now == nil {
+		return time.Now()
+	}
+	return q.Now()
+}
+
+// Add кладёт письмо в очередь, to адреса получателей или Recipient с отдельным From
+func (q *Queue) Add(from string, to []Recipient, data io.Reader) (string, error) {
+	unlock, err := q.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	return q.add(from, to, data)
+}
+
+func (q *Queue) add(from string, to []Recipient, data io.Reader) (string, error) {
+	if len(to) == 0 {
+		return "", fmt.Errorf("no recipients")
+	}
+	id, err := newID(q.now())
+	if err != nil {
+		return "", err
+	}
+	if err = writeFile(q.path(id, messageExt), func(w io.Writer) error {
+		_, err := io.Copy(w, data)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	e := Entry{ID: id, From: from, Created: q.now()}
+	for i := range to {
+		r := to[i]
+		r.Status = StatusQueued
+		r.Attempts = 0
+		r.NextAttempt = e.Created
+		e.Recipients = append(e.Recipients, r)
+	}
+	// Файл состояния пишется последним, без него письма в очереди нет
+	if err = q.save(e); err != nil {
+		os.Remove(q.path(id, messageExt))
+		return "", err
+	}
+	return id, nil
+}
+
+// Recipients получатели из адресов с общим отправителем
+func Recipients(addresses ...string) []Recipient {
+	to := make([]Recipient, len(addresses))
+	for i := range addresses {
+		to[i].Address = addresses[i]
+	}
+	return to
+}
+
+// List все письма в очереди по времени добавления
+func (q *Queue) List() ([]Entry, error) {
+	names, err := filepath.Glob(filepath.Join(q.dir, "*"+entryExt))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(names))
+	for _, name := range names {
+		e, err := q.load(strings.TrimSuffix(filepath.Base(name), entryExt))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, nil
+}
+
+// NextAttempt время ближайшей попытки, ok false если очередь пуста
+func (q *Queue) NextAttempt() (next time.Time, ok bool, err error) {
+	entries, err := q.List()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	for i := range entries {
+		for _, r := range entries[i].Recipients {
+			if r.Status == StatusQueued && (!ok || r.NextAttempt.Before(next)) {
+				next, ok = r.NextAttempt, true
+			}
+		}
+	}
+	return next, ok, nil
+}
+
+// RunOnce одна попытка доставки всем получателям, чьё время пришло
+func (q *Queue) RunOnce() ([]Result, error) {
+	var bounced []bounce
+	results, err := q.runOnce(&bounced)
+	// Bounce вызывается без блокировки, из него можно добавлять письма в очередь
+	if q.Bounce != nil {
+		for i := range bounced {
+			q.Bounce(bounced[i].entry, bounced[i].recipient)
+		}
+	}
+	return results, err
+}
+
+type bounce struct {
+	entry     Entry
+	recipient Recipient
+}
+
+// claimTimeout на столько взятым в доставку получателям сдвигается NextAttempt, чтобы их не взял другой процесс.
+// Если процесс упал, не записав результат, то после этого получатели снова в очереди
+const claimTimeout = time.Hour
+
+// claim получатели письма, взятые в доставку
+type claim struct {
+	id        string
+	envelopes []email.Envelope
+	// due номера получателей по адресу и отправителю, адрес может повторяться
+	due map[email.Envelope][]int
+}
+
+// runOnce блокирует папку только чтобы взять получателей и записать результат,
+// пока идёт отправка, другие процессы могут добавлять письма
+func (q *Queue) runOnce(bounced *[]bounce) ([]Result, error) {
+	claims, err := q.claim()
+	if err != nil {
+		return nil, err
+	}
+	var results []Result
+	for i := range claims {
+		var groups []email.Group
+		if q.Resolver != nil {
+			groups = email.PlanDeliveryResolver(claims[i].envelopes, q.Resolver)
+		} else {
+			groups = email.PlanDelivery(claims[i].envelopes)
+		}
+		for _, g := range groups {
+			sent, err := q.send(claims[i].id, g)
+			if err != nil {
+				return results, err
+			}
+			res, err := q.update(claims[i], g, sent, bounced)
+			results = append(results, res...)
+			if err != nil {
+				return results, err
+			}
+		}
+	}
+	return results, nil
+}
+
+// claim выбирает получателей, чьё время пришло, и откладывает их на claimTimeout.
+// Заодно ставит в очередь оставшиеся от прошлого запуска уведомления о недоставке и удаляет законченные письма
+func (q *Queue) claim() ([]claim, error) {
+	unlock, err := q.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries, err := q.List()
+	if err != nil {
+		return nil, err
+	}
+	now := q.now()
+	var claims []claim
+	for i := range entries {
+		e := &entries[i]
+		if err = q.notify(e); err != nil {
+			return nil, err
+		}
+		if e.done() {
+			if err = q.remove(e.ID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		c := claim{id: e.ID, due: map[email.Envelope][]int{}}
+		for j := range e.Recipients {
+			r := &e.Recipients[j]
+			if r.Status != StatusQueued || r.NextAttempt.After(now) {
+				continue
+			}
+			r.NextAttempt = now.Add(claimTimeout)
+			envelope := email.Envelope{From: r.envelopeFrom(*e), To: r.Address}
+			c.envelopes = append(c.envelopes, envelope)
+			c.due[envelope] = append(c.due[envelope], j)
+		}
+		if len(c.envelopes) == 0 {
+			continue
+		}
+		if err = q.save(*e); err != nil {
+			return nil, err
+		}
+		claims = append(claims, c)
+	}
+	return claims, nil
+}
+
+// update записывает результат транзакции группы g, сохраняется после каждой транзакции,
+// чтобы после сбоя не отправить повторно
+func (q *Queue) update(c claim, g email.Group, sent []email.Result, bounced *[]bounce) ([]Result, error) {
+	unlock, err := q.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	e, err := q.load(c.id)
+	if err != nil {
+		return nil, err
+	}
+	now := q.now()
+	jitter := q.jitter()
+	var results []Result
+	for _, res := range sent {
+		envelope := email.Envelope{From: g.From, To: res.To}
+		if len(c.due[envelope]) == 0 {
+			continue
+		}
+		r := &e.Recipients[c.due[envelope][0]]
+		c.due[envelope] = c.due[envelope][1:]
+		r.Attempts++
+		switch {
+		case res.Err == nil:
+			r.Status = StatusSent
+			r.LastError = ""
+		case permanent(res.Err):
+			q.fail(e, r, res.Err, dsnStatus(res.Err))
+		case now.Sub(e.Created) >= q.MaxAge:
+			// 4.4.7 время доставки истекло
+			q.fail(e, r, res.Err, "4.4.7")
+		default:
+			r.LastError = res.Err.Error()
+			r.NextAttempt = now.Add(q.backoff(r.Attempts, jitter))
+		}
+		results = append(results, Result{ID: e.ID, Recipient: r.Address, Status: r.Status, Err: res.Err})
+		if r.Status == StatusBounced {
+			*bounced = append(*bounced, bounce{entry: e, recipient: *r})
+		}
+	}
+	// Вместе с состоянием сохраняется и то, что уведомления о недоставке ещё надо отправить
+	if err = q.save(e); err != nil {
+		return results, err
+	}
+	if err = q.notify(&e); err != nil {
+		return results, err
+	}
+	if e.done() {
+		return results, q.remove(e.ID)
+	}
+	return results, nil
+}
+
+// fail письмо получателю r доставить не удалось
+func (q *Queue) fail(e Entry, r *Recipient, err error, status string) {
+	r.Status = StatusBounced
+	r.DSNStatus = status
+	r.LastError = err.Error()
+	// На само уведомление, у которого нет отправителя, уведомление не отправляется
+	r.Notice = q.ReportingMTA != "" && r.envelopeFrom(e) != ""
+}
+
+// notify ставит в очередь уведомления о недоставке, которые ещё не поставлены, в том числе
+// оставшиеся от прошлой попытки, если тогда это не удалось
+func (q *Queue) notify(e *Entry) error {
+	for i := range e.Recipients {
+		r := &e.Recipients[i]
+		if !r.Notice {
+			continue
+		}
+		if _, err := q.addBounce(*e, *r); err != nil {
+			return err
+		}
+		r.Notice = false
+		if err := q.save(*e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send отправляет письмо группе получателей, ошибка только если письмо не удалось прочитать
+func (q *Queue) send(id string, g email.Group) ([]email.Result, error) {
+	f, err := os.Open(q.path(id, messageExt))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return q.transport.Send(g, info.Size(), f), nil
+}
+
+// backoff задержка перед повтором после attempts попыток: MinDelay, удвоенная за каждую
+// следующую попытку, не больше MaxDelay, с разбросом jitter
+func (q *Queue) backoff(attempts int, jitter float64) time.Duration {
+	delay := q.MinDelay
+	for i := 1; i < attempts && delay < q.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > q.MaxDelay {
+		delay = q.MaxDelay
+	}
+	return delay + time.Duration(jitter*float64(delay))
+}
+
+// jitter случайный разброс задержки от -Jitter до Jitter, один на транзакцию,
+// чтобы её получатели и при повторе ушли одной транзакцией
+func (q *Queue) jitter() float64 {
+	if q.Jitter <= 0 {
+		return 0
+	}
+	return (mathrand.Float64()*2 - 1) * q.Jitter
+}
+
+func (q *Queue) path(id, ext string) string {
+	return filepath.Join(q.dir, id+ext)
+}
+
+func (q *Queue) load(id string) (Entry, error) {
+	var e Entry
+	b, err := ioutil.ReadFile(q.path(id, entryExt))
+	if err != nil {
+		return e, err
+	}
+	if err = json.Unmarshal(b, &e); err != nil {
+		return e, fmt.Errorf("queue entry %s: %s", id, err)
+	}
+	return e, nil
+}
+
+func (q *Queue) save(e Entry) error {
+	return writeFile(q.path(e.ID, entryExt), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(e)
+	})
+}
+
+func (q *Queue) remove(id string) error {
+	if err := os.Remove(q.path(id, entryExt)); err != nil {
+		return err
+	}
+	return os.Remove(q.path(id, messageExt))
+}
+
+// writeFile пишет во временный файл и переименовывает, так что файл либо старый, либо новый целиком
+func writeFile(name string, write func(io.Writer) error) error {
+	tmp := name + tmpExt
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// newID время добавления и случайная часть, так что имена файлов идут по порядку
+func newID(now time.Time) (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d.%s", now.UnixNano(), hex.EncodeToString(b)), nil
+}
@@ -0,0 +1,258 @@
+package queue
+
+import (
+	"fmt"
+	"github.com/supme/handSendEmail/email"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTransport отвечает получателям ошибками из errs по адресу, остальных принимает
+type fakeTransport struct {
+	errs   map[string]error
+	groups []email.Group
+}
+
+func (t *fakeTransport) Send(g email.Group, size int64, data io.Reader) []email.Result {
+	io.Copy(ioutil.Discard, data)
+	t.groups = append(t.groups, g)
+	results := make([]email.Result, len(g.To))
+	for i := range g.To {
+		results[i] = email.Result{To: g.To[i], Err: t.errs[g.To[i]]}
+	}
+	return results
+}
+
+var (
+	tempErr = &email.ReplyError{Command: "RCPT TO", Code: 451, Enhanced: email.EnhancedCode{Class: 4, Subject: 3, Detail: 0}, Text: []string{"try later"}}
+	permErr = &email.ReplyError{Command: "RCPT TO", Code: 550, Enhanced: email.EnhancedCode{Class: 5, Subject: 1, Detail: 1}, Text: []string{"no such user"}}
+)
+
+// testQueue очередь во временной папке без разброса задержек, время идёт только через clock
+func testQueue(t *testing.T, dir string, transport Transport, clock *time.Time) *Queue {
+	q, err := Open(dir, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Jitter = 0
+	q.ReportingMTA = "mx.domain.tld"
+	q.Now = func() time.Time {
+		return *clock
+	}
+	return q
+}
+
+func runOnce(t *testing.T, q *Queue) []Result {
+	results, err := q.RunOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+// bounces уведомления о недоставке в очереди, у них пустой отправитель
+func bounces(t *testing.T, q *Queue) []string {
+	entries, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for _, e := range entries {
+		if e.From != "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(q.path(e.ID, messageExt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, string(b))
+	}
+	return messages
+}
+
+func TestRetry(t *testing.T) {
+	clock := time.Date(2018, time.September, 24, 15, 52, 1, 0, time.UTC)
+	transport := &fakeTransport{errs: map[string]error{"vasiliy@domain.tld": tempErr}}
+	q := testQueue(t, t.TempDir(), transport, &clock)
+	if _, err := q.Add("alexey@domain.tld", Recipients("vasiliy@domain.tld"), strings.NewReader("message")); err != nil {
+		t.Fatal(err)
+	}
+
+	results := runOnce(t, q)
+	if len(results) != 1 || results[0].Status != StatusQueued || results[0].Err != tempErr {
+		t.Fatalf("expected queued, got %+v", results)
+	}
+	next, ok, err := q.NextAttempt()
+	if err != nil || !ok || !next.Equal(clock.Add(q.MinDelay)) {
+		t.Fatalf("expected next attempt %s, got %s %v %v", clock.Add(q.MinDelay), next, ok, err)
+	}
+	// До повтора ничего не отправляется
+	if results = runOnce(t, q); len(results) != 0 {
+		t.Fatalf("expected no attempts, got %+v", results)
+	}
+
+	clock = clock.Add(q.MinDelay)
+	delete(transport.errs, "vasiliy@domain.tld")
+	if results = runOnce(t, q); len(results) != 1 || results[0].Status != StatusSent {
+		t.Fatalf("expected sent, got %+v", results)
+	}
+	if entries, _ := q.List(); len(entries) != 0 {
+		t.Fatalf("expected empty queue, got %+v", entries)
+	}
+	if len(transport.groups) != 2 {
+		t.Fatalf("expected 2 transactions, got %d", len(transport.groups))
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	clock := time.Date(2018, time.September, 24, 15, 52, 1, 0, time.UTC)
+	transport := &fakeTransport{errs: map[string]error{"vasiliy@domain.tld": tempErr}}
+	q := testQueue(t, t.TempDir(), transport, &clock)
+	var bounced []Recipient
+	q.Bounce = func(e Entry, r Recipient) {
+		bounced = append(bounced, r)
+	}
+	if _, err := q.Add("alexey@domain.tld", Recipients("vasiliy@domain.tld"), strings.NewReader("Subject: test\r\n\r\nmessage")); err != nil {
+		t.Fatal(err)
+	}
+	runOnce(t, q)
+
+	clock = clock.Add(q.MaxAge)
+	results := runOnce(t, q)
+	if len(results) != 1 || results[0].Status != StatusBounced {
+		t.Fatalf("expected bounced, got %+v", results)
+	}
+	if len(bounced) != 1 || bounced[0].DSNStatus != "4.4.7" {
+		t.Fatalf("expected Bounce with 4.4.7, got %+v", bounced)
+	}
+	messages := bounces(t, q)
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 bounce, got %d", len(messages))
+	}
+	for _, expected := range []string{"To: <alexey@domain.tld>", "Final-Recipient: rfc822; vasiliy@domain.tld", "Status: 4.4.7", "Subject: test"} {
+		if !strings.Contains(messages[0], expected) {
+			t.Errorf("bounce has no %q:\n%s", expected, messages[0])
+		}
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	clock := time.Date(2018, time.September, 24, 15, 52, 1, 0, time.UTC)
+	transport := &fakeTransport{errs: map[string]error{"vasiliy@domain.tld": permErr}}
+	q := testQueue(t, t.TempDir(), transport, &clock)
+	if _, err := q.Add("alexey@domain.tld", Recipients("vasiliy@domain.tld", "fedor@domain.tld"), strings.NewReader("message")); err != nil {
+		t.Fatal(err)
+	}
+	results := runOnce(t, q)
+	if len(results) != 2 || results[0].Status != StatusBounced || results[1].Status != StatusSent {
+		t.Fatalf("expected bounced and sent, got %+v", results)
+	}
+	if len(transport.groups) != 1 {
+		t.Fatalf("expected one transaction, got %+v", transport.groups)
+	}
+	messages := bounces(t, q)
+	if len(messages) != 1 || !strings.Contains(messages[0], "Status: 5.1.1") ||
+		!strings.Contains(messages[0], "Diagnostic-Code: smtp; RCPT TO: 550 5.1.1 no such user") {
+		t.Fatalf("bad bounce %q", messages)
+	}
+	// Письмо закончено и удалено, в очереди осталось только уведомление
+	if entries, _ := q.List(); len(entries) != 1 || entries[0].From != "" {
+		t.Fatalf("expected only bounce in queue, got %+v", entries)
+	}
+}
+
+func TestNullSender(t *testing.T) {
+	clock := time.Date(2018, time.September, 24, 15, 52, 1, 0, time.UTC)
+	transport := &fakeTransport{errs: map[string]error{"alexey@domain.tld": permErr}}
+	q := testQueue(t, t.TempDir(), transport, &clock)
+	// Недоставленное уведомление о недоставке
+	if _, err := q.Add("", Recipients("alexey@domain.tld"), strings.NewReader("bounce")); err != nil {
+		t.Fatal(err)
+	}
+	if results := runOnce(t, q); len(results) != 1 || results[0].Status != StatusBounced {
+		t.Fatalf("expected bounced, got %+v", results)
+	}
+	if entries, _ := q.List(); len(entries) != 0 {
+		t.Fatalf("expected empty queue, got %+v", entries)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	clock := time.Date(2018, time.September, 24, 15, 52, 1, 0, time.UTC)
+	dir := t.TempDir()
+	transport := &fakeTransport{errs: map[string]error{"vasiliy@domain.tld": tempErr}}
+	q := testQueue(t, dir, transport, &clock)
+	id, err := q.Add("alexey@domain.tld", []Recipient{{Address: "vasiliy@domain.tld", From: "bounce+vasiliy=domain.tld@domain.tld"}}, strings.NewReader("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runOnce(t, q)
+
+	q = testQueue(t, dir, transport, &clock)
+	entries, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != id || len(entries[0].Recipients) != 1 {
+		t.Fatalf("expected entry %s, got %+v", id, entries)
+	}
+	r := entries[0].Recipients[0]
+	if r.Status != StatusQueued || r.Attempts != 1 || r.LastError != tempErr.Error() ||
+		!r.NextAttempt.Equal(clock.Add(q.MinDelay)) || r.From != "bounce+vasiliy=domain.tld@domain.tld" {
+		t.Fatalf("bad recipient state %+v", r)
+	}
+
+	clock = clock.Add(q.MinDelay)
+	delete(transport.errs, "vasiliy@domain.tld")
+	if results := runOnce(t, q); len(results) != 1 || results[0].Status != StatusSent {
+		t.Fatalf("expected sent, got %+v", results)
+	}
+	if g := transport.groups[len(transport.groups)-1]; g.From != "bounce+vasiliy=domain.tld@domain.tld" {
+		t.Fatalf("expected VERP sender, got %s", g.From)
+	}
+}
+
+func TestRetryTogether(t *testing.T) {
+	clock := time.Date(2018, time.September, 24, 15, 52, 1, 0, time.UTC)
+	transport := &fakeTransport{errs: map[string]error{"vasiliy@domain.tld": tempErr, "fedor@domain.tld": tempErr}}
+	q := testQueue(t, t.TempDir(), transport, &clock)
+	q.Jitter = defaultJitter
+	if _, err := q.Add("alexey@domain.tld", Recipients("vasiliy@domain.tld", "fedor@domain.tld"), strings.NewReader("message")); err != nil {
+		t.Fatal(err)
+	}
+	// Получатели одной транзакции повторяются в одно время и снова одной транзакцией
+	for i := 0; i < 3; i++ {
+		runOnce(t, q)
+		next, _, err := q.NextAttempt()
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock = next
+	}
+	for _, g := range transport.groups {
+		if len(g.To) != 2 {
+			t.Fatalf("recipients split into separate transactions %+v", transport.groups)
+		}
+	}
+	if len(transport.groups) != 3 {
+		t.Fatalf("expected 3 transactions, got %d", len(transport.groups))
+	}
+}
+
+func TestMessageTooBig(t *testing.T) {
+	clock := time.Date(2018, time.September, 24, 15, 52, 1, 0, time.UTC)
+	transport := &fakeTransport{errs: map[string]error{"vasiliy@domain.tld": fmt.Errorf("%w: 20 > 10", email.ErrMessageTooBig)}}
+	q := testQueue(t, t.TempDir(), transport, &clock)
+	if _, err := q.Add("alexey@domain.tld", Recipients("vasiliy@domain.tld"), strings.NewReader("message")); err != nil {
+		t.Fatal(err)
+	}
+	if results := runOnce(t, q); len(results) != 1 || results[0].Status != StatusBounced {
+		t.Fatalf("expected bounced, got %+v", results)
+	}
+	if messages := bounces(t, q); len(messages) != 1 || !strings.Contains(messages[0], "Status: 5.3.4") {
+		t.Fatalf("bad bounce %q", messages)
+	}
+}
@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"errors"
+	"github.com/supme/handSendEmail/email"
+	"io"
+	"net"
+)
+
+// SMTPTransport доставка через email.SMTP, на каждую группу новое подключение,
+// а если задан Pool, то соединение из пула
+type SMTPTransport struct {
+	// NewSMTP настроенный клиент: интерфейсы, TLS, Relay
+	NewSMTP func() *email.SMTP
+	Pool    *email.Pool
+}
+
+func (t SMTPTransport) Send(g email.Group, size int64, data io.Reader) []email.Result {
+	if t.Pool != nil {
+		return t.Pool.Deliver(g, size, data)
+	}
+	return t.NewSMTP().Deliver(g, size, data)
+}
+
+// permanentCommands ответ 5xx на эти команды относится к письму или получателю.
+// 5xx на EHLO, STARTTLS или AUTH это ошибка настройки или сессии, из-за неё письма не возвращаются
+var permanentCommands = map[string]bool{
+	"MAIL FROM": true,
+	"RCPT TO":   true,
+	"DATA":      true,
+}
+
+// permanent повторять отправку бесполезно: ответ 5xx на MAIL FROM, RCPT TO или DATA, Null MX,
+// домена не существует, в адресе CR или LF или письмо больше, чем принимает сервер. Если не удалось подключиться ни к одному MX, то ошибка постоянная, только если постоянные все попытки
+func permanent(err error) bool {
+	var connectErr *email.ConnectError
+	if errors.As(err, &connectErr) && len(connectErr.Attempts) > 0 {
+		for i := range connectErr.Attempts {
+			if !permanent(connectErr.Attempts[i].Err) {
+				return false
+			}
+		}
+		return true
+	}
+	var replyErr *email.ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Permanent() && permanentCommands[replyErr.Command]
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsNotFound
+	}
+	return errors.Is(err, email.ErrNullMX) || errors.Is(err, email.ErrBadLine) || errors.Is(err, email.ErrMessageTooBig)
+}
@@ -0,0 +1,49 @@
+package email
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+)
+
+// Relay сервер отправки (submission), через который уходят все письма вместо MX получателя
+type Relay struct {
+	// Addr host:port, обычно 587 со STARTTLS или 465 с TLS сразу после подключения
+	Addr string
+	// ImplicitTLS TLS сразу после подключения, для порта 465 включается сам
+	ImplicitTLS bool
+	// Auth smtp.PlainAuth, smtp.CRAMMD5Auth, LoginAuth или XOAUTH2Auth, nil если сервер пускает без AUTH
+	Auth smtp.Auth
+}
+
+// SetRelay отправлять через сервер отправки, а не напрямую на MX получателя.
+// Для порта 587 стоит задать SetTLS(TLSRequired, ...), иначе пароль может уйти открытым текстом
+func (s *SMTP) SetRelay(relay Relay) *SMTP {
+	s.relay = &relay
+	return s
+}
+
+func (s *SMTP) connectRelay() error {
+	host, port, err := net.SplitHostPort(s.relay.Addr)
+	if err != nil {
+		return err
+	}
+	if err = s.open(s.iface, host, s.relay.Addr, host, s.relay.ImplicitTLS || port == "465"); err != nil {
+		return fmt.Errorf("can not connect to relay %s: %s", s.relay.Addr, err)
+	}
+	s.connHost, s.connIface = s.relay.Addr, s.iface
+	return nil
+}
+
+// CommandAuth AUTH на сервере отправки, без Relay.Auth ничего не делает
+func (s *SMTP) CommandAuth() error {
+	if s.relay == nil || s.relay.Auth == nil {
+		return nil
+	}
+	if ok, _ := s.client.Extension("AUTH"); !ok {
+		return fmt.Errorf("server does not support AUTH")
+	}
+	err := replyError("AUTH", s.client.Auth(s.relay.Auth))
+	s.traceCommand("AUTH", "", err)
+	return err
+}
@@ -0,0 +1,137 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// https://tools.ietf.org/html/rfc5321#section-4.2
+// https://tools.ietf.org/html/rfc3463
+
+var enhancedCodeRegexp = regexp.MustCompile(`^([245])\.(\d{1,3})\.(\d{1,3})(\s+|$)`)
+
+// EnhancedCode расширенный код ответа class.subject.detail, нулевой если сервер его не прислал
+type EnhancedCode struct {
+	Class   int
+	Subject int
+	Detail  int
+}
+
+func (c EnhancedCode) String() string {
+	if c.Class == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d", c.Class, c.Subject, c.Detail)
+}
+
+// ReplyError ответ сервера с кодом ошибки
+type ReplyError struct {
+	// Command команда, на которую пришёл ответ, например "RCPT TO"
+	Command  string
+	Code     int
+	Enhanced EnhancedCode
+	// Text строки ответа без кодов
+	Text []string
+}
+
+func (e *ReplyError) Error() string {
+	code := strconv.Itoa(e.Code)
+	if e.Enhanced.Class != 0 {
+		code += " " + e.Enhanced.String()
+	}
+	return fmt.Sprintf("%s: %s %s", e.Command, code, strings.Join(e.Text, " "))
+}
+
+// Temporary 4xx, стоит повторить позже
+func (e *ReplyError) Temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+// Permanent 5xx, повторять бесполезно
+func (e *ReplyError) Permanent() bool {
+	return e.Code >= 500 && e.Code < 600
+}
+
+// IsMailboxUnavailable ящика нет или он отключён, адрес стоит исключить из рассылки, если ошибка постоянная
+func (e *ReplyError) IsMailboxUnavailable() bool {
+	if e.Enhanced.Class != 0 {
+		// X.1.1 нет такого ящика, X.1.10 Null MX, X.2.1 ящик отключён
+		return e.Enhanced.Subject == 1 && (e.Enhanced.Detail == 1 || e.Enhanced.Detail == 10) ||
+			e.Enhanced.Subject == 2 && e.Enhanced.Detail == 1
+	}
+	switch e.Code {
+	case 450, 550, 551, 553:
+		return true
+	}
+	return false
+}
+
+// IsPolicyRejection письмо отклонено политикой сервера: спам, репутация, DMARC и т.п., адрес при этом может быть рабочим
+func (e *ReplyError) IsPolicyRejection() bool {
+	if e.Enhanced.Class != 0 {
+		return e.Enhanced.Subject == 7
+	}
+	return e.Code == 554
+}
+
+// replyError превращает ошибку textproto в *ReplyError, остальные ошибки возвращает как есть
+func replyError(command string, err error) error {
+	var protoErr *textproto.Error
+	if err == nil || !errors.As(err, &protoErr) {
+		return err
+	}
+	reply := &ReplyError{Command: command, Code: protoErr.Code}
+	for i, line := range strings.Split(protoErr.Msg, "\n") {
+		// Класс расширенного кода совпадает с первой цифрой кода ответа
+		if match := enhancedCodeRegexp.FindStringSubmatch(line); match != nil && match[1] == strconv.Itoa(protoErr.Code/100) {
+			// Код в первой строке, в остальных он обычно повторяется
+			if i == 0 {
+				reply.Enhanced.Class, _ = strconv.Atoi(match[1])
+				reply.Enhanced.Subject, _ = strconv.Atoi(match[2])
+				reply.Enhanced.Detail, _ = strconv.Atoi(match[3])
+			}
+			line = line[len(match[0]):]
+		}
+		reply.Text = append(reply.Text, line)
+	}
+	return reply
+}
+
+// isReplyError сервер ответил ошибкой, соединение при этом рабочее
+func isReplyError(err error) bool {
+	var reply *ReplyError
+	return errors.As(err, &reply)
+}
+
+// connectionError после такой ошибки соединение использовать нельзя: это не ответ сервера и не отказ отправить команду
+func connectionError(err error) bool {
+	return err != nil && !isReplyError(err) && !errors.Is(err, ErrBadLine) && !errors.Is(err, ErrMessageTooBig)
+}
+
+// dataWriter переводит ошибку ответа на конец DATA в *ReplyError и считает принятые письма
+type dataWriter struct {
+	io.WriteCloser
+	s *SMTP
+	// n сколько байт письма записано
+	n int64
+}
+
+func (w *dataWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *dataWriter) Close() error {
+	err := replyError("DATA", w.WriteCloser.Close())
+	if err == nil {
+		w.s.messages++
+	}
+	w.s.traceCommand("DATA", strconv.FormatInt(w.n, 10), err)
+	return err
+}
@@ -0,0 +1,156 @@
+package email
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// Resolver DNS запросы, которые делает пакет email
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	// LookupIP A и AAAA записи
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+	// LookupAddr PTR записи
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	// LookupTLSA name вида _25._tcp.mx.domain.tld
+	LookupTLSA(ctx context.Context, name string) ([]TLSA, error)
+}
+
+// TLSA запись https://tools.ietf.org/html/rfc6698#section-2.1
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// DefaultResolver системный DNS, используется, если Resolver не задан
+var DefaultResolver Resolver = NewDNSResolver("")
+
+// DNSResolver Resolver поверх net.Resolver
+type DNSResolver struct {
+	resolver *net.Resolver
+	// server адрес DNS сервера host:port, пусто для системного
+	server  string
+	timeout time.Duration
+}
+
+// NewDNSResolver server адрес DNS сервера, например "8.8.8.8:53" или "8.8.8.8", пусто для системного
+func NewDNSResolver(server string) *DNSResolver {
+	r := &DNSResolver{
+		resolver: net.DefaultResolver,
+		timeout:  time.Second * 5,
+	}
+	if server == "" {
+		return r
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	r.server = server
+	r.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dialer := net.Dialer{Timeout: r.timeout}
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+	return r
+}
+
+func (r *DNSResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return r.resolver.LookupMX(ctx, name)
+}
+
+func (r *DNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return r.resolver.LookupIP(ctx, "ip", host)
+}
+
+func (r *DNSResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.resolver.LookupAddr(ctx, addr)
+}
+
+func (r *DNSResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r.resolver.LookupTXT(ctx, name)
+}
+
+// LookupTLSA net.Resolver не умеет TLSA, поэтому запрос делаем сами
+// к заданному серверу или к первому серверу из /etc/resolv.conf
+func (r *DNSResolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, error) {
+	server := r.server
+	if server == "" {
+		server = systemDNSServer()
+	}
+	return lookupTLSA(ctx, server, r.timeout, name)
+}
+
+// MapResolver Resolver из заранее заданных записей, например для проверки маршрутизации без сети.
+// Ключи это имена без точки в конце в нижнем регистре, для PTR адрес.
+// Возвращаются копии записей, так что их можно менять и использовать один MapResolver из нескольких горутин
+type MapResolver struct {
+	MX   map[string][]*net.MX
+	IP   map[string][]net.IP
+	PTR  map[string][]string
+	TXT  map[string][]string
+	TLSA map[string][]TLSA
+}
+
+func (r *MapResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if mxs, ok := r.MX[mapKey(name)]; ok {
+		copied := make([]*net.MX, len(mxs))
+		for i := range mxs {
+			mx := *mxs[i]
+			copied[i] = &mx
+		}
+		return copied, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *MapResolver) LookupIP(_ context.Context, host string) ([]net.IP, error) {
+	if ips, ok := r.IP[mapKey(host)]; ok {
+		copied := make([]net.IP, len(ips))
+		for i := range ips {
+			copied[i] = append(net.IP(nil), ips[i]...)
+		}
+		return copied, nil
+	}
+	return nil, notFound(host)
+}
+
+func (r *MapResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	if names, ok := r.PTR[addr]; ok {
+		return append([]string(nil), names...), nil
+	}
+	return nil, notFound(addr)
+}
+
+func (r *MapResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if txts, ok := r.TXT[mapKey(name)]; ok {
+		return append([]string(nil), txts...), nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *MapResolver) LookupTLSA(_ context.Context, name string) ([]TLSA, error) {
+	if records, ok := r.TLSA[mapKey(name)]; ok {
+		copied := make([]TLSA, len(records))
+		for i := range records {
+			copied[i] = records[i]
+			copied[i].Data = append([]byte(nil), records[i].Data...)
+		}
+		return copied, nil
+	}
+	return nil, notFound(name)
+}
+
+func mapKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
@@ -0,0 +1,167 @@
+package email
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer SMTP сервер для тестов, записывает полученные команды
+type fakeServer struct {
+	l net.Listener
+	// ehlo расширения в ответе на EHLO
+	ehlo []string
+	// tls если задан, то сервер поддерживает STARTTLS
+	tls *tls.Config
+	// reply ответ на команду, если пусто, то "250 ok"
+	reply func(command string) string
+
+	mu       sync.Mutex
+	commands []string
+	conns    int
+}
+
+func newFakeServer(t *testing.T, ehlo ...string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{l: l, ehlo: ehlo}
+	t.Cleanup(func() {
+		l.Close()
+	})
+	go s.serve()
+	return s
+}
+
+// client SMTP клиент, который отправляет всё через этот сервер
+func (s *fakeServer) client() *SMTP {
+	return NewSmtp(&Iface{IP: net.ParseIP("127.0.0.1"), Hostname: "localhost"}).
+		SetRelay(Relay{Addr: s.l.Addr().String()})
+}
+
+// log полученные команды, подключение отмечается как "CONNECT"
+func (s *fakeServer) log() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *fakeServer) record(command string) {
+	s.mu.Lock()
+	s.commands = append(s.commands, command)
+	s.mu.Unlock()
+}
+
+func (s *fakeServer) serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.record("CONNECT")
+		go s.session(c)
+	}
+}
+
+func (s *fakeServer) session(c net.Conn) {
+	defer func() {
+		c.Close()
+	}()
+	r := bufio.NewReader(c)
+	c.Write([]byte("220 fake\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		s.record(line)
+		switch {
+		case strings.HasPrefix(line, "EHLO"):
+			ehlo := "250-fake\r\n"
+			extensions := s.ehlo
+			if s.tls != nil {
+				if _, ok := c.(*tls.Conn); !ok {
+					extensions = append(extensions, "STARTTLS")
+				}
+			}
+			for _, extension := range extensions {
+				ehlo += "250-" + extension + "\r\n"
+			}
+			c.Write([]byte(ehlo + "250 HELP\r\n"))
+		case line == "STARTTLS":
+			c.Write([]byte("220 go ahead\r\n"))
+			conn := tls.Server(c, s.tls)
+			if err = conn.Handshake(); err != nil {
+				return
+			}
+			c = conn
+			r = bufio.NewReader(c)
+		case line == "DATA":
+			c.Write([]byte("354 go ahead\r\n"))
+			var data []string
+			for {
+				if line, err = r.ReadString('\n'); err != nil {
+					return
+				}
+				if line = strings.TrimRight(line, "\r\n"); line == "." {
+					break
+				}
+				data = append(data, line)
+			}
+			s.record("DATA " + strings.Join(data, "\n"))
+			c.Write([]byte(s.answer("DATA END") + "\r\n"))
+		case line == "QUIT":
+			c.Write([]byte("221 bye\r\n"))
+			return
+		default:
+			c.Write([]byte(s.answer(line) + "\r\n"))
+		}
+	}
+}
+
+func (s *fakeServer) answer(command string) string {
+	if s.reply != nil {
+		if reply := s.reply(command); reply != "" {
+			return reply
+		}
+	}
+	return "250 ok"
+}
+
+// selfSigned сертификат для 127.0.0.1, подписанный сам собой, и пул с ним для проверки
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
@@ -1,17 +1,38 @@
 package email
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/smtp"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type SMTP struct {
-	iface  *Iface
-	conn   net.Conn
-	client *smtp.Client
+	iface     *Iface
+	conn      net.Conn
+	client    *smtp.Client
+	tlsMode   TLSMode
+	tlsConfig *tls.Config
+	tlsErr    error
+	// tlsVerifyErr почему в режиме TLSOpportunistic сертификат сервера не проверен
+	tlsVerifyErr error
+	relay        *Relay
+	trace        Trace
+	resolver     Resolver
+	// ifaces дополнительные интерфейсы для адресов другого семейства
+	ifaces       []*Iface
+	ipPreference IPPreference
+	// connHost и connIface MX сервер или Relay.Addr и интерфейс открытого соединения
+	connHost  string
+	connIface *Iface
+	// messages сколько писем принято сервером через это соединение
+	messages int
 }
 
 // Iface сетевой интерфейс
@@ -23,6 +44,11 @@ type Iface struct {
 // GetInterfaces получаем список доступных интерфейсов на этой машине
 // mapping соответствие локального адреса глобальному, если мы находимся за NAT
 func GetInterfaces(mapping map[string]string) ([]*Iface, error) {
+	return GetInterfacesResolver(mapping, DefaultResolver)
+}
+
+// GetInterfacesResolver как GetInterfaces, но имена интерфейсов ищутся через resolver
+func GetInterfacesResolver(mapping map[string]string, resolver Resolver) ([]*Iface, error) {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		return nil, err
@@ -41,7 +67,7 @@ func GetInterfaces(mapping map[string]string) ([]*Iface, error) {
 		} else {
 			lookup = iface.IP.String()
 		}
-		names, err := net.LookupAddr(lookup)
+		names, err := resolver.LookupAddr(context.Background(), lookup)
 		if err != nil || len(names) < 1 {
 			continue
 		}
@@ -55,45 +81,90 @@ func GetInterfaces(mapping map[string]string) ([]*Iface, error) {
 func NewSmtp(iface *Iface) *SMTP {
 	var s SMTP
 	s.iface = iface
+	s.tlsMode = TLSOpportunistic
+	s.resolver = DefaultResolver
 	return &s
 }
 
+// SetResolver DNS для поиска MX серверов и их адресов
+func (s *SMTP) SetResolver(resolver Resolver) *SMTP {
+	s.resolver = resolver
+	return s
+}
+
 func (s *SMTP) CommandConnectAndHello(emailTo string) error {
-	var err error
-	splitEmail := strings.Split(emailTo, "@")
-	if len(splitEmail) != 2 {
+	// В локальной части тоже может быть @, домен после последней
+	i := strings.LastIndex(emailTo, "@")
+	if i <= 0 || i == len(emailTo)-1 {
 		return fmt.Errorf("bad email format")
 	}
-	if err = s.connect(splitEmail[1]); err != nil {
-		return err
-	}
-	return nil
+	err := s.connect(emailTo[i+1:])
+	s.traceCommand("CONNECT", emailTo[i+1:], err)
+	return err
 }
 
 func (s *SMTP) CommandVerify(email string) error {
 	fmt.Printf("%#v\n", s.client)
 	if err := s.client.Verify(email); err != nil {
-		return err
+		return replyError("VRFY", err)
 	}
 	return nil
 }
 
 func (s *SMTP) CommandFrom(email string) error {
-	if err := s.client.Mail(email); err != nil {
-		return err
+	err := replyError("MAIL FROM", s.client.Mail(email))
+	s.traceCommand("MAIL FROM", email, err)
+	return err
+}
+
+// MaxSize максимальный размер письма из расширения SIZE в ответе на EHLO, 0 если не ограничен
+func (s *SMTP) MaxSize() int64 {
+	ok, param := s.client.Extension("SIZE")
+	if !ok {
+		return 0
 	}
-	return nil
+	size, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
 }
 
-func (s *SMTP) CommandRcpt(email string) error {
-	if err := s.client.Rcpt(email); err != nil {
+// CommandFromSize MAIL FROM с параметром SIZE, если сервер его поддерживает,
+// письмо больше допустимого сервером размера отклоняется до отправки.
+// BODY=8BITMIME и SMTPUTF8 добавляются так же, как в CommandFrom
+func (s *SMTP) CommandFromSize(email string, size int64) error {
+	if ok, _ := s.client.Extension("SIZE"); !ok {
+		return s.CommandFrom(email)
+	}
+	err := s.commandFromSize(email, size)
+	s.traceCommand("MAIL FROM", email, err)
+	return err
+}
+
+func (s *SMTP) commandFromSize(email string, size int64) error {
+	command, err := s.mailCommand(email, size)
+	if err != nil {
 		return err
 	}
-	return nil
+	id, err := s.client.Text.Cmd("%s", command)
+	if err != nil {
+		return err
+	}
+	s.client.Text.StartResponse(id)
+	defer s.client.Text.EndResponse(id)
+	_, _, err = s.client.Text.ReadResponse(250)
+	return replyError("MAIL FROM", err)
+}
+
+func (s *SMTP) CommandRcpt(email string) error {
+	err := replyError("RCPT TO", s.client.Rcpt(email))
+	s.traceCommand("RCPT TO", email, err)
+	return err
 }
 
 func (s *SMTP) CommandData(data []byte) error {
-	w, err := s.client.Data()
+	w, err := s.CommandDataWriter()
 	if err != nil {
 		return err
 	}
@@ -103,8 +174,41 @@ func (s *SMTP) CommandData(data []byte) error {
 	return w.Close()
 }
 
+// CommandDataWriter отправляет DATA и возвращает writer для потоковой записи письма,
+// Close завершает передачу точкой и читает ответ сервера
+func (s *SMTP) CommandDataWriter() (io.WriteCloser, error) {
+	w, err := s.client.Data()
+	if err != nil {
+		err = replyError("DATA", err)
+		s.traceCommand("DATA", "", err)
+		return nil, err
+	}
+	return &dataWriter{WriteCloser: w, s: s}, nil
+}
+
+// CommandReset RSET, отменяет начатую транзакцию, после него соединение готово к следующему MAIL FROM
+func (s *SMTP) CommandReset() error {
+	err := replyError("RSET", s.client.Reset())
+	s.traceCommand("RSET", "", err)
+	return err
+}
+
+// CommandNoop NOOP, проверяет что соединение живо и не даёт серверу закрыть его по таймауту
+func (s *SMTP) CommandNoop() error {
+	err := replyError("NOOP", s.client.Noop())
+	s.traceCommand("NOOP", "", err)
+	return err
+}
+
+// Messages сколько писем сервер принял через это соединение
+func (s *SMTP) Messages() int {
+	return s.messages
+}
+
 func (s *SMTP) CommandQuit() error {
-	return s.client.Quit()
+	err := replyError("QUIT", s.client.Quit())
+	s.traceCommand("QUIT", "", err)
+	return err
 }
 
 func (s *SMTP) CommandClose() error {
@@ -112,32 +216,141 @@ func (s *SMTP) CommandClose() error {
 }
 
 func (s *SMTP) connect(host string) error {
-	var (
-		err  error
-		errs []string
-		mxs  []*net.MX
-	)
-	if mxs, err = net.LookupMX(host); err != nil {
+	s.tlsErr = nil
+	s.tlsVerifyErr = nil
+	s.messages = 0
+	if s.relay != nil {
+		return s.connectRelay()
+	}
+	connectErr := &ConnectError{Domain: host}
+	// Адрес вида user@[IPv6:2001:db8::1] доставляется прямо на этот адрес без MX
+	ip, ok, err := addressLiteral(host)
+	if err != nil {
 		return err
 	}
-	dialer := net.Dialer{
-		LocalAddr: &net.TCPAddr{IP: s.iface.IP},
-		Timeout:   time.Second * 5,
+	if ok {
+		if s.connectIPs(connectErr, host, ip.String(), []net.IP{ip}) {
+			return nil
+		}
+		return connectErr
+	}
+	mxs, err := lookupMX(s.resolver, host)
+	if err != nil {
+		return err
 	}
 	for i := range mxs {
-		if s.conn, err = dialer.Dial("tcp", mxs[i].Host+":25"); err != nil {
-			errs = append(errs, err.Error())
+		// Exchange не любит точку в конце доменного имени, а сертификат выписан на имя без неё
+		mxHost := strings.TrimSuffix(mxs[i].Host, ".")
+		ips, err := s.resolver.LookupIP(context.Background(), mxHost)
+		if err != nil {
+			connectErr.Attempts = append(connectErr.Attempts, Attempt{Host: mxHost, Err: err})
 			continue
 		}
-		if s.client, err = smtp.NewClient(s.conn, host); err != nil {
-			errs = append(errs, err.Error())
+		if s.connectIPs(connectErr, host, mxHost, ips) {
+			return nil
+		}
+	}
+	return connectErr
+}
+
+// connectIPs пробует все подходящие по s.ipPreference адреса сервера через интерфейс того же семейства,
+// неудачные попытки добавляет в connectErr
+func (s *SMTP) connectIPs(connectErr *ConnectError, host, mxHost string, ips []net.IP) bool {
+	ordered := s.orderIPs(ips)
+	if len(ordered) == 0 {
+		connectErr.Attempts = append(connectErr.Attempts, Attempt{Host: mxHost, Err: fmt.Errorf("no addresses allowed by IP preference %s", s.ipPreference)})
+		return false
+	}
+	for _, ip := range ordered {
+		iface := s.ifaceFor(ip)
+		if iface == nil {
+			connectErr.Attempts = append(connectErr.Attempts, Attempt{Host: mxHost, IP: ip, Err: fmt.Errorf("no local %s interface", familyName(ip))})
 			continue
 		}
-		if err = s.client.Hello(s.iface.Hostname); err != nil {
-			errs = append(errs, err.Error())
+		if err := s.open(iface, host, net.JoinHostPort(ip.String(), "25"), mxHost, false); err != nil {
+			connectErr.Attempts = append(connectErr.Attempts, Attempt{Host: mxHost, IP: ip, Err: err})
 			continue
 		}
+		s.connHost, s.connIface = mxHost, iface
+		return true
+	}
+	return false
+}
+
+// open подключается к addr, здоровается и договаривается о TLS: сразу при implicitTLS,
+// иначе STARTTLS по режиму s.tlsMode. host имя для smtp.NewClient, serverName имя в сертификате
+func (s *SMTP) open(iface *Iface, host, addr, serverName string, implicitTLS bool) error {
+	if implicitTLS {
+		return s.dial(iface, host, addr, s.tlsConfigFor(serverName))
+	}
+	if err := s.dial(iface, host, addr, nil); err != nil {
+		return err
+	}
+	err := s.startTLS(serverName, s.tlsConfigFor(serverName))
+	if err == nil {
+		return nil
+	}
+	s.client.Close()
+	if s.tlsMode == TLSRequired {
+		return err
+	}
+	// Сертификаты многих MX серверов не совпадают с их именем, шифрование без проверки
+	// всё равно лучше открытого текста, RFC 7435
+	var verifyErr *tls.CertificateVerificationError
+	if errors.As(err, &verifyErr) {
+		s.tlsVerifyErr = fmt.Errorf("%s: %s", serverName, err)
+		if err = s.dial(iface, host, addr, nil); err != nil {
+			return err
+		}
+		config := s.tlsConfigFor(serverName)
+		config.InsecureSkipVerify = true
+		if err = s.startTLS(serverName, config); err == nil {
+			return nil
+		}
+		s.client.Close()
+	}
+	// Соединение после неудачного STARTTLS использовать нельзя, подключаемся заново без TLS
+	s.tlsErr = fmt.Errorf("%s: %s", serverName, err)
+	return s.dial(iface, host, addr, nil)
+}
+
+// dial подключается к серверу через iface и здоровается, с tlsConfig соединение сразу в TLS
+func (s *SMTP) dial(iface *Iface, host, addr string, tlsConfig *tls.Config) error {
+	var err error
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: iface.IP},
+		Timeout:   time.Second * 5,
+	}
+	if tlsConfig != nil {
+		s.conn, err = tls.DialWithDialer(&dialer, "tcp", addr, tlsConfig)
+	} else {
+		s.conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if s.client, err = smtp.NewClient(s.conn, host); err != nil {
+		s.conn.Close()
+		return err
+	}
+	if err = s.client.Hello(iface.Hostname); err != nil {
+		s.client.Close()
+		return replyError("EHLO", err)
+	}
+	return nil
+}
+
+// startTLS STARTTLS по режиму s.tlsMode, в режиме TLSOpportunistic отсутствие STARTTLS у сервера не ошибка
+func (s *SMTP) startTLS(serverName string, config *tls.Config) error {
+	if s.tlsMode == TLSNone {
+		return nil
+	}
+	if ok, _ := s.client.Extension("STARTTLS"); !ok {
+		if s.tlsMode == TLSRequired {
+			return fmt.Errorf("server does not support STARTTLS")
+		}
+		s.tlsErr = fmt.Errorf("%s: server does not support STARTTLS", serverName)
 		return nil
 	}
-	return fmt.Errorf("can not connect, errors: %s", strings.Join(errs, "; "))
+	return replyError("STARTTLS", s.client.StartTLS(config))
 }
@@ -0,0 +1,79 @@
+package email
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// TLSMode использовать ли STARTTLS после EHLO
+type TLSMode int
+
+const (
+	// TLSNone всё идёт открытым текстом
+	TLSNone TLSMode = iota
+	// TLSOpportunistic STARTTLS, если сервер его поддерживает. Если сертификат не прошёл проверку,
+	// то STARTTLS повторяется без проверки, при другой ошибке переподключаемся без TLS
+	TLSOpportunistic
+	// TLSRequired без TLS письмо не отправляется
+	TLSRequired
+)
+
+func (m TLSMode) String() string {
+	switch m {
+	case TLSNone:
+		return "none"
+	case TLSOpportunistic:
+		return "opportunistic"
+	case TLSRequired:
+		return "required"
+	}
+	return fmt.Sprintf("TLSMode(%d)", int(m))
+}
+
+// SetTLS режим STARTTLS и настройки TLS. Проверку сертификата выключает InsecureSkipVerify,
+// минимальную версию задаёт MinVersion, ServerName всегда выставляется в имя MX сервера.
+// Если config nil, то проверка сертификата включена, а минимальная версия TLS 1.2
+func (s *SMTP) SetTLS(mode TLSMode, config *tls.Config) *SMTP {
+	s.tlsMode = mode
+	s.tlsConfig = config
+	return s
+}
+
+func (s *SMTP) tlsConfigFor(serverName string) *tls.Config {
+	var config *tls.Config
+	if s.tlsConfig == nil {
+		config = &tls.Config{MinVersion: tls.VersionTLS12}
+	} else {
+		config = s.tlsConfig.Clone()
+	}
+	config.ServerName = serverName
+	return config
+}
+
+// TLSConnectionState состояние TLS соединения, ok false если соединение без TLS
+func (s *SMTP) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	if s.client == nil {
+		return tls.ConnectionState{}, false
+	}
+	return s.client.TLSConnectionState()
+}
+
+// TLSInfo версия TLS и шифр, например "TLS 1.3 TLS_AES_128_GCM_SHA256", или пустая строка без TLS
+func (s *SMTP) TLSInfo() string {
+	state, ok := s.TLSConnectionState()
+	if !ok {
+		return ""
+	}
+	return tls.VersionName(state.Version) + " " + tls.CipherSuiteName(state.CipherSuite)
+}
+
+// TLSError почему в режиме TLSOpportunistic письмо ушло без TLS, nil если TLS не пробовали или он удался
+func (s *SMTP) TLSError() error {
+	return s.tlsErr
+}
+
+// TLSVerifyError почему в режиме TLSOpportunistic сертификат сервера не проверен и соединение зашифровано
+// без проверки, nil если сертификат проверен или TLS нет
+func (s *SMTP) TLSVerifyError() error {
+	return s.tlsVerifyErr
+}
@@ -0,0 +1,52 @@
+package email
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestOpportunisticTLS(t *testing.T) {
+	cert, pool := selfSigned(t)
+	server := newFakeServer(t)
+	server.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	// Сертификат проверен
+	s := server.client().SetTLS(TLSOpportunistic, &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12})
+	if err := s.CommandConnectAndHello("user@domain.tld"); err != nil {
+		t.Fatal(err)
+	}
+	if s.TLSInfo() == "" || s.TLSError() != nil || s.TLSVerifyError() != nil {
+		t.Fatalf("expected verified TLS, got %q %v %v", s.TLSInfo(), s.TLSError(), s.TLSVerifyError())
+	}
+	s.CommandQuit()
+
+	// Сертификат не проверить, но соединение всё равно зашифровано
+	s = server.client().SetTLS(TLSOpportunistic, nil)
+	if err := s.CommandConnectAndHello("user@domain.tld"); err != nil {
+		t.Fatal(err)
+	}
+	if s.TLSInfo() == "" || s.TLSError() != nil || s.TLSVerifyError() == nil {
+		t.Fatalf("expected unverified TLS, got %q %v %v", s.TLSInfo(), s.TLSError(), s.TLSVerifyError())
+	}
+	s.CommandQuit()
+
+	// С TLSRequired без проверки не отправляем
+	s = server.client().SetTLS(TLSRequired, nil)
+	if err := s.CommandConnectAndHello("user@domain.tld"); err == nil {
+		t.Fatalf("expected certificate error, got TLS %q", s.TLSInfo())
+	}
+}
+
+func TestOpportunisticTLSFallback(t *testing.T) {
+	// Сервер объявил STARTTLS, но TLS у него не работает
+	server := newFakeServer(t)
+	server.tls = &tls.Config{}
+	s := server.client().SetTLS(TLSOpportunistic, nil)
+	if err := s.CommandConnectAndHello("user@domain.tld"); err != nil {
+		t.Fatal(err)
+	}
+	if s.TLSInfo() != "" || s.TLSError() == nil {
+		t.Fatalf("expected plaintext fallback, got %q %v", s.TLSInfo(), s.TLSError())
+	}
+	s.CommandQuit()
+}
@@ -0,0 +1,18 @@
+package email
+
+// Trace вызывается после каждой команды соединения. command имя команды: CONNECT (подключение, EHLO и STARTTLS),
+// AUTH, MAIL FROM, RCPT TO, DATA, RSET, NOOP или QUIT, arg домен, адрес или для DATA число отправленных байт,
+// err ошибка команды. Через s можно узнать состояние соединения, например TLSInfo или Pipelining
+type Trace func(s *SMTP, command, arg string, err error)
+
+// SetTrace функция, которая видит каждую команду соединения, например чтобы показать ход отправки
+func (s *SMTP) SetTrace(trace Trace) *SMTP {
+	s.trace = trace
+	return s
+}
+
+func (s *SMTP) traceCommand(command, arg string, err error) {
+	if s.trace != nil {
+		s.trace(s, command, arg, err)
+	}
+}
@@ -0,0 +1,44 @@
+package email
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		var ehlo []string
+		if pipelining {
+			ehlo = []string{"PIPELINING"}
+		}
+		server := newFakeServer(t, ehlo...)
+		server.reply = func(command string) string {
+			if command == "RCPT TO:<bad@domain.tld>" {
+				return "550 5.1.1 no such user"
+			}
+			return ""
+		}
+		var trace []string
+		s := server.client().SetTrace(func(s *SMTP, command, arg string, err error) {
+			line := command + " " + arg
+			if err != nil {
+				line += " " + err.Error()
+			}
+			trace = append(trace, line)
+		})
+		g := Group{Domain: "domain.tld", From: "a@sender.tld", To: []string{"1@domain.tld", "bad@domain.tld"}}
+		s.Deliver(g, 5, strings.NewReader("hello"))
+		expected := []string{
+			"CONNECT domain.tld",
+			"MAIL FROM a@sender.tld",
+			"RCPT TO 1@domain.tld",
+			"RCPT TO bad@domain.tld RCPT TO: 550 5.1.1 no such user",
+			"DATA 5",
+			"QUIT ",
+		}
+		if !reflect.DeepEqual(trace, expected) {
+			t.Fatalf("pipelining %v: expected %q, got %q", pipelining, expected, trace)
+		}
+	}
+}
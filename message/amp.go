@@ -0,0 +1,52 @@
+package message
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// https://amp.dev/documentation/guides-and-tutorials/learn/email-spec/amp-email-format/
+
+var ampRequired = []struct {
+	re   *regexp.Regexp
+	name string
+}{
+	{regexp.MustCompile(`(?i)^\s*<!doctype html>`), "<!doctype html>"},
+	{regexp.MustCompile(`(?i)<html\s[^>]*(⚡4email|amp4email)`), "<html ⚡4email>"},
+	{regexp.MustCompile(`(?i)<head>`), "<head>"},
+	{regexp.MustCompile(`(?i)<meta\s+charset="?utf-8"?\s*/?>`), `<meta charset="utf-8">`},
+	{regexp.MustCompile(`(?i)<script\s+async\s+src="https://cdn\.ampproject\.org/v0\.js"\s*>\s*</script>`), `<script async src="https://cdn.ampproject.org/v0.js"></script>`},
+	{regexp.MustCompile(`(?i)<style\s+amp4email-boilerplate\s*>\s*body\s*\{\s*visibility\s*:\s*hidden\s*;?\s*\}\s*</style>`), "<style amp4email-boilerplate>body{visibility:hidden}</style>"},
+	{regexp.MustCompile(`(?i)<body>`), "<body>"},
+}
+
+// TextAMP AMP версия письма, добавляется в multipart/alternative между text/plain и text/html.
+// Gmail показывает AMP только в подписанных DKIM письмах
+func (m *Message) TextAMP(textAMP string) *Message {
+	m.textAMP = textAMP
+	return m
+}
+
+// validateAMP проверяет обязательную обвязку AMP письма и наличие DKIM подписи
+func (m Message) validateAMP() error {
+	if m.textAMP == "" {
+		return nil
+	}
+	var missing []string
+	for i := range ampRequired {
+		if !ampRequired[i].re.MatchString(m.textAMP) {
+			missing = append(missing, ampRequired[i].name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("AMP part is missing required markup: %s", strings.Join(missing, ", "))
+	}
+	if m.dkimPrivateKey == "" {
+		return fmt.Errorf("AMP part requires DKIM signature")
+	}
+	if m.textHTML == "" {
+		return fmt.Errorf("AMP part requires text/html fallback")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package message
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+const defaultCharset = "utf-8"
+
+// Charset кодировка заголовков и текстовых частей письма, например koi8-r, windows-1251 или iso-2022-jp.
+// По умолчанию utf-8
+func (m *Message) Charset(charset string) *Message {
+	m.charset = charset
+	return m
+}
+
+func (m Message) getCharset() string {
+	if m.charset == "" {
+		return defaultCharset
+	}
+	return strings.ToLower(m.charset)
+}
+
+func (m Message) charsetEncoder() (*encoding.Encoder, error) {
+	enc, err := ianaindex.MIME.Encoding(m.getCharset())
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("unsupported charset %s", m.getCharset())
+	}
+	return enc.NewEncoder(), nil
+}
+
+// encodeString перекодирует строку в кодировку письма,
+// если какой-то символ в ней непредставим, то возвращается ошибка
+func (m Message) encodeString(s string) (string, error) {
+	if m.getCharset() == defaultCharset {
+		return s, nil
+	}
+	enc, err := m.charsetEncoder()
+	if err != nil {
+		return "", err
+	}
+	encoded, err := enc.String(s)
+	if err != nil {
+		return "", fmt.Errorf("can not encode %q to %s: %s", s, m.getCharset(), err)
+	}
+	return encoded, nil
+}
+
+// encodeHeader значение заголовка в виде encoded-word в кодировке письма
+func (m Message) encodeHeader(s string) (string, error) {
+	encoded, err := m.encodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return mime.BEncoding.Encode(m.getCharset(), encoded), nil
+}
+
+func (m Message) encodeMail(mail Mail) (string, error) {
+	if mail.name == "" {
+		return mail.email, nil
+	}
+	name, err := m.encodeHeader(mail.name)
+	if err != nil {
+		return "", err
+	}
+	return name + " <" + mail.email + ">", nil
+}
+
+func (m Message) encodeMails(ms []Mail) (string, error) {
+	msStr := make([]string, len(ms))
+	for i := range ms {
+		s, err := m.encodeMail(ms[i])
+		if err != nil {
+			return "", err
+		}
+		msStr[i] = s
+	}
+	return strings.Join(msStr, ", "), nil
+}
@@ -1 +1,8 @@
 module github.com/supme/handSendEmail/message
+
+go 1.25.0
+
+require (
+	golang.org/x/text v0.40.0
+	gopkg.in/yaml.v2 v2.4.0
+)
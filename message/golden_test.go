@@ -0,0 +1,129 @@
+package message
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata/golden")
+
+// Картинка 1x1 для зависящего файла
+const goldenGIF = "R0lGODlhAQABAIAAAP///wAAACH5BAEAAAAALAAAAAABAAEAAAICRAEAOw=="
+
+// zeroReader источник "случайности" из одних нулей
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+var goldenOptions = WriterOptions{
+	Now: func() time.Time {
+		return time.Date(2018, time.September, 24, 15, 52, 1, 0, time.UTC)
+	},
+	MessageID: func(domain string) string {
+		return "golden@" + domain
+	},
+	Rand: zeroReader{},
+}
+
+var goldenSpecs = map[string]MessageSpec{
+	"simple": {
+		Version:   SpecVersion,
+		From:      AddressSpec{Name: "Алексей", Email: "alexey@domain.tld"},
+		To:        []AddressSpec{{Name: "Василий", Email: "vasiliy@domain.tld"}},
+		Subject:   "Тестовый email",
+		TextPlain: "Привет! Это я.",
+		TextHTML:  "<h1>Привет! Это я.</h1>",
+	},
+	"full": {
+		Version:    SpecVersion,
+		From:       AddressSpec{Name: "Алексей", Email: "alexey@domain.tld"},
+		To:         []AddressSpec{{Name: "Василий", Email: "vasiliy@domain.tld"}},
+		Cc:         []AddressSpec{{Email: "fedor@domain.tld"}},
+		ReturnPath: &AddressSpec{Email: "bounce@domain.tld"},
+		Subject:    "Тестовый email",
+		TextPlain:  "Привет! Это я.\n[картинка меня]",
+		TextHTML:   "<h1>Привет! Это я.</h1><img src=\"cid:me.gif\"/>",
+		Priority:   "high",
+		Headers:    map[string]string{"X-Mailer": "handSendEmail"},
+		List:       &ListSpec{ID: "news.domain.tld", UnsubscribeURL: "https://domain.tld/unsubscribe"},
+		Related:    []PartSpec{{Name: "me.gif", Base64: goldenGIF}},
+		Attachments: []PartSpec{
+			{Name: "hello.txt", Base64: "0J/RgNC40LLQtdGCIQo="},
+		},
+	},
+	// Ключ только для тестов, подпись с ним одна и та же при каждом запуске
+	"dkim": {
+		Version:   SpecVersion,
+		From:      AddressSpec{Name: "Алексей", Email: "alexey@domain.tld"},
+		To:        []AddressSpec{{Name: "Василий", Email: "vasiliy@domain.tld"}},
+		Subject:   "Тестовый email",
+		TextPlain: "Привет! Это я.",
+		DKIM:      &DKIMSpec{Selector: "golden", Domain: "domain.tld", KeyFile: "testdata/dkim.pem"},
+	},
+	"multilingual": {
+		Version: SpecVersion,
+		From:    AddressSpec{Name: "Алексей", Email: "alexey@domain.tld"},
+		To:      []AddressSpec{{Email: "vasiliy@domain.tld"}},
+		Languages: []LanguageSpec{
+			{Tag: "ru", Subject: "Уведомление", TextPlain: "Привет!"},
+			{Tag: "en", Subject: "Notice", TextPlain: "Hello!"},
+		},
+	},
+}
+
+// TestGolden письма с детерминированными WriterOptions должны совпадать с testdata/golden побайтно,
+// go test -update перезаписывает эталоны
+func TestGolden(t *testing.T) {
+	for name, spec := range goldenSpecs {
+		e, err := spec.ToMessage()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		buf := &bytes.Buffer{}
+		if _, err = e.WriterOptions(goldenOptions).Write(buf); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		file := filepath.Join("testdata", "golden", name+".eml")
+		if *update {
+			if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		golden, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(golden, buf.Bytes()) {
+			continue
+		}
+		want, got := strings.Split(string(golden), "\r\n"), strings.Split(buf.String(), "\r\n")
+		for i := 0; i < len(want) || i < len(got); i++ {
+			var w, g string
+			if i < len(want) {
+				w = want[i]
+			}
+			if i < len(got) {
+				g = got[i]
+			}
+			if w != g {
+				t.Errorf("%s line %d:\n- %s\n+ %s", file, i+1, w, g)
+				break
+			}
+		}
+	}
+}
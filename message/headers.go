@@ -0,0 +1,248 @@
+package message
+
+import (
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+type Priority int
+
+const (
+	PriorityHigh Priority = iota + 1
+	PriorityNormal
+	PriorityLow
+)
+
+// priorityHeaders значения X-Priority, Importance и Priority для каждого приоритета
+var priorityHeaders = map[Priority][3]string{
+	PriorityHigh:   {"1 (Highest)", "high", "urgent"},
+	PriorityNormal: {"3 (Normal)", "normal", "normal"},
+	PriorityLow:    {"5 (Lowest)", "low", "non-urgent"},
+}
+
+// https://tools.ietf.org/html/rfc3834#section-5
+type AutoSubmitted string
+
+const (
+	AutoSubmittedNo            AutoSubmitted = "no"
+	AutoSubmittedAutoGenerated AutoSubmitted = "auto-generated"
+	AutoSubmittedAutoReplied   AutoSubmitted = "auto-replied"
+)
+
+// managedHeaders заголовки, которые пишутся самим письмом и не могут быть заданы через AddHeaders
+var managedHeaders = map[string]bool{
+	"Mime-Version":          true,
+	"Date":                  true,
+	"Message-Id":            true,
+	"From":                  true,
+	"Sender":                true,
+	"Reply-To":              true,
+	"To":                    true,
+	"Cc":                    true,
+	"Return-Path":           true,
+	"Subject":               true,
+	"Organization":          true,
+	"X-Priority":            true,
+	"Importance":            true,
+	"Priority":              true,
+	"Auto-Submitted":        true,
+	"Content-Type":          true,
+	"Content-Language":      true,
+	"Dkim-Signature":        true,
+	"List-Id":               true,
+	"List-Unsubscribe":      true,
+	"List-Unsubscribe-Post": true,
+	"Precedence":            true,
+	"Feedback-Id":           true,
+}
+
+// dkimSignedHeaders заголовки, которые попадают в h= подписи DKIM
+var dkimSignedHeaders = map[string]bool{
+	"From":                  true,
+	"Sender":                true,
+	"Reply-To":              true,
+	"To":                    true,
+	"Cc":                    true,
+	"Subject":               true,
+	"List-Id":               true,
+	"List-Unsubscribe":      true,
+	"List-Unsubscribe-Post": true,
+	"Precedence":            true,
+	"Feedback-ID":           true,
+}
+
+// Sender фактический отправитель, если он отличается от From
+func (m *Message) Sender(email Mail) *Message {
+	m.sender = email
+	return m
+}
+
+// ReplyTo добавляет адрес для ответа, их может быть несколько
+func (m *Message) ReplyTo(email Mail) *Message {
+	m.replyTo = append(m.replyTo, email)
+	return m
+}
+
+func (m *Message) Organization(organization string) *Message {
+	m.organization = organization
+	return m
+}
+
+// Priority пишется сразу в X-Priority, Importance и Priority, чтобы их понимали все клиенты
+func (m *Message) Priority(priority Priority) *Message {
+	m.priority = priority
+	return m
+}
+
+// AutoSubmitted для автоответов и автоматических уведомлений
+func (m *Message) AutoSubmitted(autoSubmitted AutoSubmitted) *Message {
+	m.autoSubmitted = autoSubmitted
+	return m
+}
+
+// headerList все заголовки письма кроме MIME-Version, Date и Content-Type в порядке их записи
+func (m Message) headerList() ([]header, error) {
+	var headers []header
+	add := func(name, value string) {
+		headers = append(headers, header{name, value})
+	}
+	addMail := func(name string, email Mail) error {
+		if email.email == "" {
+			return nil
+		}
+		value, err := m.encodeMail(email)
+		if err != nil {
+			return err
+		}
+		add(name, value)
+		return nil
+	}
+	addMails := func(name string, mails []Mail) error {
+		if len(mails) == 0 {
+			return nil
+		}
+		value, err := m.encodeMails(mails)
+		if err != nil {
+			return err
+		}
+		add(name, value)
+		return nil
+	}
+
+	from, err := m.encodeMail(m.from)
+	if err != nil {
+		return nil, err
+	}
+	add("From", from)
+	if m.sender.email != "" {
+		if _, err = mail.ParseAddress(m.sender.email); err != nil {
+			return nil, fmt.Errorf("bad Sender address %q: %s", m.sender.email, err)
+		}
+	}
+	if err = addMail("Sender", m.sender); err != nil {
+		return nil, err
+	}
+	for i := range m.replyTo {
+		if _, err = mail.ParseAddress(m.replyTo[i].email); err != nil {
+			return nil, fmt.Errorf("bad Reply-To address %q: %s", m.replyTo[i].email, err)
+		}
+	}
+	if err = addMails("Reply-To", m.replyTo); err != nil {
+		return nil, err
+	}
+	to, err := m.encodeMails(m.to)
+	if err != nil {
+		return nil, err
+	}
+	add("To", to)
+	if err = addMails("Cc", m.cc); err != nil {
+		return nil, err
+	}
+	// Bcc в заголовки не пишется, иначе скрытых получателей увидят все, они есть только в конверте
+	if err = addMail("Return-Path", m.returnPath); err != nil {
+		return nil, err
+	}
+	subject := m.subject
+	if subject == "" {
+		subject = m.multilingualSubject()
+	}
+	if subject, err = m.encodeHeader(subject); err != nil {
+		return nil, err
+	}
+	add("Subject", subject)
+	// Когда все языки в одной части, их перечисляем для всего письма
+	if len(m.languages) > 0 && m.multilingualPlain {
+		add("Content-Language", m.contentLanguage())
+	}
+
+	if m.organization != "" {
+		if strings.ContainsAny(m.organization, "\r\n") {
+			return nil, fmt.Errorf("bad Organization: must not contain CR or LF")
+		}
+		organization, err := m.encodeHeader(m.organization)
+		if err != nil {
+			return nil, err
+		}
+		add("Organization", organization)
+	}
+	if m.priority != 0 {
+		values, ok := priorityHeaders[m.priority]
+		if !ok {
+			return nil, fmt.Errorf("bad priority %d", m.priority)
+		}
+		add("X-Priority", values[0])
+		add("Importance", values[1])
+		add("Priority", values[2])
+	}
+	if m.autoSubmitted != "" {
+		switch m.autoSubmitted {
+		case AutoSubmittedNo, AutoSubmittedAutoGenerated, AutoSubmittedAutoReplied:
+		default:
+			return nil, fmt.Errorf("bad Auto-Submitted value %q", m.autoSubmitted)
+		}
+		add("Auto-Submitted", string(m.autoSubmitted))
+	}
+
+	headers = append(headers, m.listHeaders()...)
+
+	// Произвольные заголовки пишем последними и по алфавиту, чтобы порядок не менялся от раза к разу
+	names := make([]string, 0, len(m.headers))
+	for name := range m.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("bad header name %q", name)
+		}
+		if managedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			return nil, fmt.Errorf("header %s can not be set with AddHeaders", name)
+		}
+		if strings.ContainsAny(m.headers[name], "\r\n") {
+			return nil, fmt.Errorf("bad header %s: value must not contain CR or LF", name)
+		}
+		value, err := m.encodeHeader(m.headers[name])
+		if err != nil {
+			return nil, err
+		}
+		add(name, value)
+	}
+
+	return headers, nil
+}
+
+// validHeaderName https://tools.ietf.org/html/rfc5322#section-2.2
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 33 || name[i] > 126 || name[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// https://tools.ietf.org/html/rfc5322#section-2.1.1
+const maxLineLength = 998
+
+// lintMaxSize размер письма, больше которого его примут далеко не все сервера
+const lintMaxSize = 10 * 1024 * 1024
+
+var cidRegexp = regexp.MustCompile(`(?i)cid:([^"'\s)>]+)`)
+
+type Severity int
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Finding замечание линтера к письму
+type Finding struct {
+	Severity Severity
+	Code     string
+	Message  string
+}
+
+func (f Finding) String() string {
+	return f.Severity.String() + ": " + f.Message
+}
+
+// Lint проверяет письмо перед отправкой и возвращает список замечаний,
+// пустой список означает, что замечаний нет
+func (m Message) Lint() []Finding {
+	var findings []Finding
+	add := func(severity Severity, code, format string, a ...interface{}) {
+		findings = append(findings, Finding{Severity: severity, Code: code, Message: fmt.Sprintf(format, a...)})
+	}
+
+	// Проверяем заголовки в том виде, в котором они уйдут
+	buf := &bytes.Buffer{}
+	if _, err := m.HeaderWrite(buf); err != nil {
+		add(SeverityError, "header", "can not write headers: %s", err)
+	} else {
+		// From и Date пишутся всегда, пустой From проверяется по адресу ниже
+		if _, err := mail.ReadMessage(bytes.NewReader(buf.Bytes())); err != nil {
+			add(SeverityError, "header", "can not parse headers: %s", err)
+		}
+		for i, line := range strings.Split(buf.String(), "\r\n") {
+			if len(line) > maxLineLength {
+				add(SeverityError, "long-line", "header line %d is %d characters long, max is %d", i+1, len(line), maxLineLength)
+			}
+		}
+	}
+
+	if m.from.email == "" {
+		add(SeverityError, "missing-from", "From address is empty")
+	} else if _, err := mail.ParseAddress(m.from.email); err != nil {
+		add(SeverityError, "invalid-address", "From address %q is invalid: %s", m.from.email, err)
+	}
+	if m.returnPath.email != "" {
+		if _, err := mail.ParseAddress(m.returnPath.email); err != nil {
+			add(SeverityError, "invalid-address", "Return-Path address %q is invalid: %s", m.returnPath.email, err)
+		}
+	}
+	recipients := m.GetRecipientEmails()
+	if len(recipients) == 0 {
+		add(SeverityError, "no-recipients", "message has no recipients")
+	}
+	for _, recipient := range recipients {
+		if _, err := mail.ParseAddress(recipient); err != nil {
+			add(SeverityError, "invalid-address", "recipient address %q is invalid: %s", recipient, err)
+		}
+	}
+
+	if strings.TrimSpace(m.subject) == "" && strings.TrimSpace(m.multilingualSubject()) == "" {
+		add(SeverityWarning, "empty-subject", "subject is empty")
+	}
+	// С языками TextPlain и TextHTML не пишутся, проверяем версии на каждом языке
+	if m.textHTML != "" && m.textPlain == "" && len(m.languages) == 0 {
+		add(SeverityWarning, "no-text-alternative", "HTML body has no text/plain alternative")
+	}
+	for i := range m.languages {
+		if m.languages[i].textHTML != "" && m.languages[i].textPlain == "" {
+			add(SeverityWarning, "no-text-alternative", "%s: HTML body has no text/plain alternative", m.languages[i].tag)
+		}
+	}
+	if m.textHTML == "" && m.textPlain == "" && len(m.languages) == 0 {
+		add(SeverityWarning, "empty-body", "message has no body")
+	}
+
+	if err := m.validateAMP(); err != nil {
+		add(SeverityError, "amp", "%s", err)
+	}
+
+	// Content-ID зависящего файла это его имя
+	related := map[string]bool{}
+	for i := range m.relatedFile {
+		related[m.relatedFile[i].fileName()] = false
+	}
+	htmls := []string{m.textHTML}
+	for i := range m.languages {
+		htmls = append(htmls, m.languages[i].textHTML)
+	}
+	for _, match := range cidRegexp.FindAllStringSubmatch(strings.Join(htmls, "\n"), -1) {
+		if _, ok := related[match[1]]; !ok {
+			add(SeverityError, "missing-cid", "HTML references cid:%s, but there is no related part with this Content-ID", match[1])
+			continue
+		}
+		related[match[1]] = true
+	}
+	for i := range m.relatedFile {
+		name := m.relatedFile[i].fileName()
+		if !related[name] {
+			add(SeverityWarning, "unused-related", "related part %s is never referenced from HTML", name)
+		}
+	}
+
+	size, err := m.EncodedSize()
+	if err != nil {
+		add(SeverityError, "size", "can not calculate message size: %s", err)
+	} else if m.maxSize > 0 && size > m.maxSize {
+		add(SeverityError, "large-size", "message size %d exceeds max size %d", size, m.maxSize)
+	} else if size > lintMaxSize {
+		add(SeverityWarning, "large-size", "message size %d is larger than %d, many servers will reject it", size, lintMaxSize)
+	}
+
+	if m.dkimPrivateKey != "" && m.dkimDomain != "" {
+		fromDomain := m.from.email[strings.LastIndex(m.from.email, "@")+1:]
+		if !domainAligned(fromDomain, m.dkimDomain) {
+			add(SeverityWarning, "dkim-alignment", "From domain %s is not aligned with DKIM d=%s", fromDomain, m.dkimDomain)
+		}
+	}
+
+	return findings
+}
+
+// domainAligned домен совпадает с d= или является его поддоменом (relaxed alignment)
+func domainAligned(domain, dkimDomain string) bool {
+	domain = strings.ToLower(domain)
+	dkimDomain = strings.ToLower(dkimDomain)
+	return domain == dkimDomain || strings.HasSuffix(domain, "."+dkimDomain)
+}
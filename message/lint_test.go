@@ -0,0 +1,35 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+)
+
+// codes коды замечаний в порядке выдачи
+func codes(findings []Finding) []string {
+	var c []string
+	for i := range findings {
+		c = append(c, findings[i].Code)
+	}
+	return c
+}
+
+func TestLintMissingFrom(t *testing.T) {
+	m := NewMessage().To(NewMail("", "vasiliy@domain.tld")).Subject("Тест").TextPlain("Привет!")
+	if c := codes(m.Lint()); !reflect.DeepEqual(c, []string{"missing-from"}) {
+		t.Fatalf("expected one missing-from, got %v", c)
+	}
+}
+
+func TestLintTextAlternative(t *testing.T) {
+	m := NewMessage().From(NewMail("", "alexey@domain.tld")).To(NewMail("", "vasiliy@domain.tld")).
+		AddLanguage("ru", "Тест", "Привет!", "<p>Привет!</p>").
+		AddLanguage("en", "Test", "", "<p>Hello!</p>")
+	findings := m.Lint()
+	if c := codes(findings); !reflect.DeepEqual(c, []string{"no-text-alternative"}) {
+		t.Fatalf("expected no-text-alternative, got %v", c)
+	}
+	if expected := "en: HTML body has no text/plain alternative"; findings[0].Message != expected {
+		t.Fatalf("expected %q, got %q", expected, findings[0].Message)
+	}
+}
@@ -0,0 +1,110 @@
+package message
+
+import (
+	"net/url"
+	"strings"
+)
+
+// https://tools.ietf.org/html/rfc2369
+// https://tools.ietf.org/html/rfc8058
+
+// unsubscribeTokenPlaceholder заменяется в URL отписки на токен получателя
+const unsubscribeTokenPlaceholder = "{token}"
+
+type header struct {
+	name  string
+	value string
+}
+
+// ListUnsubscribe задаёт адреса отписки для заголовка List-Unsubscribe.
+// В unsubscribeURL можно указать {token}, он будет заменён на токен получателя.
+// Для https адреса добавляется List-Unsubscribe-Post: List-Unsubscribe=One-Click
+func (m *Message) ListUnsubscribe(mailto, unsubscribeURL string) *Message {
+	m.unsubscribeMailto = mailto
+	m.unsubscribeURL = unsubscribeURL
+	return m
+}
+
+// UnsubscribeToken функция получения токена отписки по email получателя,
+// если не задана, то в качестве токена используется сам email
+func (m *Message) UnsubscribeToken(f func(email string) string) *Message {
+	m.unsubscribeToken = f
+	return m
+}
+
+// Recipient получатель, для которого сейчас формируется письмо
+func (m *Message) Recipient(email string) *Message {
+	m.recipient = email
+	return m
+}
+
+func (m *Message) ListID(listID string) *Message {
+	m.listID = listID
+	return m
+}
+
+func (m *Message) Precedence(precedence string) *Message {
+	m.precedence = precedence
+	return m
+}
+
+func (m *Message) FeedbackID(feedbackID string) *Message {
+	m.feedbackID = feedbackID
+	return m
+}
+
+func (m Message) getRecipient() string {
+	if m.recipient != "" {
+		return m.recipient
+	}
+	if len(m.to) > 0 {
+		return m.to[0].email
+	}
+	return ""
+}
+
+func (m Message) unsubscribeLink() string {
+	if !strings.Contains(m.unsubscribeURL, unsubscribeTokenPlaceholder) {
+		return m.unsubscribeURL
+	}
+	recipient := m.getRecipient()
+	token := recipient
+	if m.unsubscribeToken != nil {
+		token = m.unsubscribeToken(recipient)
+	}
+	return strings.Replace(m.unsubscribeURL, unsubscribeTokenPlaceholder, url.QueryEscape(token), -1)
+}
+
+// listHeaders заголовки для массовых рассылок в порядке их записи
+func (m Message) listHeaders() []header {
+	var headers []header
+	if m.listID != "" {
+		headers = append(headers, header{"List-Id", m.listID})
+	}
+	var unsubscribe []string
+	if m.unsubscribeMailto != "" {
+		mailto := m.unsubscribeMailto
+		if !strings.HasPrefix(mailto, "mailto:") {
+			mailto = "mailto:" + mailto
+		}
+		unsubscribe = append(unsubscribe, "<"+mailto+">")
+	}
+	link := m.unsubscribeLink()
+	if link != "" {
+		unsubscribe = append(unsubscribe, "<"+link+">")
+	}
+	if len(unsubscribe) > 0 {
+		headers = append(headers, header{"List-Unsubscribe", strings.Join(unsubscribe, ", ")})
+	}
+	// One-Click по RFC 8058 возможен только с https адресом
+	if strings.HasPrefix(link, "https://") {
+		headers = append(headers, header{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"})
+	}
+	if m.precedence != "" {
+		headers = append(headers, header{"Precedence", m.precedence})
+	}
+	if m.feedbackID != "" {
+		headers = append(headers, header{"Feedback-ID", m.feedbackID})
+	}
+	return headers
+}
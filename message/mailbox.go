@@ -0,0 +1,241 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// https://www.loc.gov/preservation/digital/formats/fdd/fdd000385.shtml
+// https://cr.yp.to/proto/maildir.html
+
+var maildirCounter int64
+
+// lfWriter переводит строки в LF, а с quoteFrom ещё и экранирует строки ">*From " по правилам mboxrd
+type lfWriter struct {
+	quoteFrom bool
+	line      []byte
+	writer    io.Writer
+}
+
+func (w *lfWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.line = append(w.line, p...)
+			return n + len(p), nil
+		}
+		w.line = append(w.line, p[:i]...)
+		n += i + 1
+		p = p[i+1:]
+		if err = w.writeLine(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Close дописывает последнюю строку, если она не закончена переводом строки
+func (w *lfWriter) Close() error {
+	if len(w.line) == 0 {
+		return nil
+	}
+	return w.writeLine()
+}
+
+func (w *lfWriter) writeLine() error {
+	line := bytes.TrimSuffix(w.line, []byte{'\r'})
+	if w.quoteFrom && bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+		line = append([]byte{'>'}, line...)
+	}
+	line = append(line, '\n')
+	w.line = w.line[:0]
+	_, err := w.writer.Write(line)
+	return err
+}
+
+// WriteMbox дописывает письмо в mbox в формате mboxrd, w обычно файл открытый с os.O_APPEND
+func (m Message) WriteMbox(w io.Writer) error {
+	from := m.GetEnvelopeFrom(m.getRecipient())
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString("From " + from + " " + m.now().UTC().Format(time.ANSIC) + "\n"); err != nil {
+		return err
+	}
+	lw := &lfWriter{quoteFrom: true, writer: bw}
+	if _, err := m.Write(lw); err != nil {
+		return err
+	}
+	if err := lw.Close(); err != nil {
+		return err
+	}
+	// Пустая строка отделяет письма друг от друга
+	if _, err := bw.WriteString("\n"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// AppendMboxFile дописывает письмо в mbox файл, создавая его при необходимости
+func (m Message) AppendMboxFile(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if err = m.WriteMbox(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WriteMaildir кладёт письмо в Maildir: пишет в tmp и переносит в new,
+// возвращает путь к файлу письма
+func (m Message) WriteMaildir(dir string) (string, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return "", err
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	// "/" и ":" в имени файла недопустимы
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	now := m.now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddInt64(&maildirCounter, 1), hostname)
+
+	tmpName := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	bw := bufio.NewWriter(f)
+	lw := &lfWriter{writer: bw}
+	_, err = m.Write(lw)
+	if err == nil {
+		err = lw.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+	newName := filepath.Join(dir, "new", name)
+	if err = os.Rename(tmpName, newName); err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+	return newName, nil
+}
+
+// MboxReader читает письма из mbox в формате mboxrd
+type MboxReader struct {
+	r *bufio.Reader
+	// started строка From текущего письма уже прочитана
+	started bool
+}
+
+func NewMboxReader(r io.Reader) *MboxReader {
+	return &MboxReader{r: bufio.NewReader(r)}
+}
+
+// Next возвращает следующее письмо или io.EOF, если писем больше нет
+func (r *MboxReader) Next() (*mail.Message, error) {
+	buf := &bytes.Buffer{}
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		if bytes.HasPrefix(line, []byte("From ")) {
+			if r.started || buf.Len() > 0 {
+				// Начало следующего письма, его строка From уже прочитана
+				r.started = true
+				return r.parse(buf)
+			}
+			r.started = true
+			continue
+		}
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			line = line[1:]
+		}
+		buf.Write(line)
+		if err == io.EOF {
+			break
+		}
+	}
+	if !r.started && buf.Len() == 0 {
+		return nil, io.EOF
+	}
+	r.started = false
+	return r.parse(buf)
+}
+
+func (r *MboxReader) parse(buf *bytes.Buffer) (*mail.Message, error) {
+	// Последняя пустая строка разделитель писем, а не часть письма
+	b := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	return mail.ReadMessage(bytes.NewReader(b))
+}
+
+// MaildirReader читает письма из new и cur папок Maildir
+type MaildirReader struct {
+	files []string
+}
+
+func NewMaildirReader(dir string) (*MaildirReader, error) {
+	var files []string
+	for _, sub := range []string{"new", "cur"} {
+		infos, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return nil, err
+		}
+		for i := range infos {
+			if infos[i].Mode().IsRegular() && !strings.HasPrefix(infos[i].Name(), ".") {
+				files = append(files, filepath.Join(dir, sub, infos[i].Name()))
+			}
+		}
+	}
+	// Имена начинаются со времени доставки, так что это примерно порядок доставки
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+	return &MaildirReader{files: files}, nil
+}
+
+// Next возвращает следующее письмо или io.EOF, если писем больше нет
+func (r *MaildirReader) Next() (*mail.Message, error) {
+	if len(r.files) == 0 {
+		return nil, io.EOF
+	}
+	name := r.files[0]
+	r.files = r.files[1:]
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return mail.ReadMessage(bytes.NewReader(b))
+}
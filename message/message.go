@@ -3,32 +3,25 @@ package message
 
 import (
 	"crypto"
-	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
-	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// Разделители по умолчанию, их можно заменить через WriterOptions.Boundary
 const (
-	boundaryMixed            = "===============1_MIXED========"
-	boundaryMixedBegin       = "--" + boundaryMixed + "\r\n"
-	boundaryMixedEnd         = "--" + boundaryMixed + "--\r\n"
-	boundaryRelated          = "===============2_RELATED======"
-	boundaryRelatedBegin     = "--" + boundaryRelated + "\r\n"
-	boundaryRelatedEnd       = "--" + boundaryRelated + "--\r\n"
-	boundaryAlternative      = "===============3_ALTERNATIVE=="
-	boundaryAlternativeBegin = "--" + boundaryAlternative + "\r\n"
-	boundaryAlternativeEnd   = "--" + boundaryAlternative + "--\r\n"
+	boundaryMixed       = "===============1_MIXED========"
+	boundaryRelated     = "===============2_RELATED======"
+	boundaryAlternative = "===============3_ALTERNATIVE=="
 )
 
 type Mail struct {
@@ -61,17 +54,44 @@ func JoinMails(ms []Mail) string {
 type Message struct {
 	dkimSelector   string
 	dkimPrivateKey string
+	dkimDomain     string
 	from           Mail
 	to             []Mail
 	cc             []Mail
 	bcc            []Mail
 	returnPath     Mail
+	sender         Mail
+	replyTo        []Mail
+	organization   string
+	priority       Priority
+	autoSubmitted  AutoSubmitted
 	headers        map[string]string
 	subject        string
 	textHTML       string
 	textPlain      string
-	relatedFile    []*os.File
-	attachmentFile []*os.File
+	textAMP        string
+	// languages версии текста на разных языках, если есть, то пишутся вместо textPlain и textHTML
+	languages           []language
+	multilingualPreface string
+	multilingualPlain   bool
+	relatedFile         []part
+	attachmentFile      []part
+
+	recipient         string
+	unsubscribeMailto string
+	unsubscribeURL    string
+	unsubscribeToken  func(email string) string
+	listID            string
+	precedence        string
+	feedbackID        string
+
+	charset    string
+	maxSize    int64
+	verp       bool
+	options    WriterOptions
+	boundaries map[BoundaryKind]string
+	// sizeOnly файлы не читаются, а только учитывается размер их base64 представления
+	sizeOnly bool
 }
 
 func NewMessage() *Message {
@@ -109,6 +129,12 @@ func (m *Message) SetDKIM(dkimSelector, dkimPrivateKey string) *Message {
 	return m
 }
 
+// DKIMDomain домен d= подписи, если не задан, то используется домен отправителя
+func (m *Message) DKIMDomain(domain string) *Message {
+	m.dkimDomain = domain
+	return m
+}
+
 func (m *Message) GetFromEmail() string {
 	return m.from.email
 }
@@ -133,6 +159,9 @@ func (m *Message) Subject(subject string) *Message {
 }
 
 func (m *Message) AddHeaders(headers map[string]string) *Message {
+	if m.headers == nil {
+		m.headers = make(map[string]string, len(headers))
+	}
 	for k, v := range headers {
 		m.headers[k] = v
 	}
@@ -150,19 +179,70 @@ func (m *Message) TextPlain(textPlain string) *Message {
 }
 
 func (m *Message) AddRelatedFile(file *os.File) *Message {
-	m.relatedFile = append(m.relatedFile, file)
+	return m.AddRelatedFileType(file, "")
+}
+
+// AddRelatedFileType добавляет зависящий файл с явно заданным Content-Type
+func (m *Message) AddRelatedFileType(file *os.File, contentType string) *Message {
+	m.relatedFile = append(m.relatedFile, part{file: file, contentType: contentType})
 	return m
 }
 
 func (m *Message) AddAttachmentFile(file *os.File) *Message {
-	m.attachmentFile = append(m.attachmentFile, file)
+	return m.AddAttachmentFileType(file, "")
+}
+
+// AddAttachmentFileType добавляет вложение с явно заданным Content-Type
+func (m *Message) AddAttachmentFileType(file *os.File, contentType string) *Message {
+	m.attachmentFile = append(m.attachmentFile, part{file: file, contentType: contentType})
 	return m
 }
 
-func (m Message) Write(w io.Writer) {
-	m.SignDKIM(w)
-	m.HeaderWrite(w)
-	m.BodyWrite(w)
+// Write пишет письмо целиком, файлы читаются и кодируются прямо в w,
+// возвращает количество записанных байт и первую ошибку
+func (m Message) Write(writer io.Writer) (int64, error) {
+	m, err := m.withBoundaries()
+	if err != nil {
+		return 0, err
+	}
+	if m.maxSize > 0 && !m.sizeOnly {
+		size, err := m.EncodedSize()
+		if err != nil {
+			return 0, err
+		}
+		if size > m.maxSize {
+			return 0, fmt.Errorf("message size %d exceeds max size %d", size, m.maxSize)
+		}
+	}
+	if !m.sizeOnly {
+		if err := m.validateAMP(); err != nil {
+			return 0, err
+		}
+	}
+	w := newErrWriter(writer)
+	if m.dkimPrivateKey != "" {
+		if err := m.SignDKIM(w); err != nil {
+			return w.n, err
+		}
+	}
+	if _, err := m.HeaderWrite(w); err != nil {
+		return w.n, err
+	}
+	_, err = m.BodyWrite(w)
+	return w.n, err
+}
+
+// MaxSize максимальный размер письма, Write вернёт ошибку не записав ничего, если письмо больше
+func (m *Message) MaxSize(size int64) *Message {
+	m.maxSize = size
+	return m
+}
+
+// EncodedSize точный размер письма в том виде, в котором оно уйдёт в DATA,
+// содержимое файлов при этом не читается и не кодируется
+func (m Message) EncodedSize() (int64, error) {
+	m.sizeOnly = true
+	return m.Write(ioutil.Discard)
 }
 
 func (m Message) SignDKIM(w io.Writer) error {
@@ -171,6 +251,14 @@ func (m Message) SignDKIM(w io.Writer) error {
 		return fmt.Errorf("bad email format")
 	}
 	domain := splitEmail[1]
+	identity := m.from.email
+	if m.dkimDomain != "" {
+		domain = m.dkimDomain
+		// i= должен быть в домене d= или его поддомене
+		if !domainAligned(splitEmail[1], domain) {
+			identity = "@" + domain
+		}
+	}
 	block, _ := pem.Decode([]byte(m.dkimPrivateKey))
 	if block == nil {
 		return fmt.Errorf("failed to parse PEM block containing the public key")
@@ -181,12 +269,18 @@ func (m Message) SignDKIM(w io.Writer) error {
 	}
 	hasher := crypto.SHA1
 	headerHash := hasher.New()
+	signedHeaders, err := m.dkimHeaders()
+	if err != nil {
+		return err
+	}
+	headerNames := make([]string, len(signedHeaders))
 	func(w io.Writer) {
-		w.Write([]byte("From: " + m.from.String() + "\r\n"))
-		w.Write([]byte("To: " + JoinMails(m.to) + "\r\n"))
-		w.Write([]byte("Subject: " + mime.BEncoding.Encode("utf-8", m.subject) + "\r\n"))
+		for i := range signedHeaders {
+			w.Write([]byte(signedHeaders[i].name + ": " + signedHeaders[i].value + "\r\n"))
+			headerNames[i] = signedHeaders[i].name
+		}
 	}(headerHash)
-	b, err := rsa.SignPKCS1v15(rand.Reader, privateKey, hasher, headerHash.Sum(nil))
+	b, err := rsa.SignPKCS1v15(m.random(), privateKey, hasher, headerHash.Sum(nil))
 	if err != nil {
 		return err
 	}
@@ -194,24 +288,23 @@ func (m Message) SignDKIM(w io.Writer) error {
 	bodyHash := hasher.New()
 	var l int
 	func(w io.Writer) {
-		n, _ := w.Write([]byte(boundaryMixedBegin))
+		n, _ := w.Write([]byte(m.boundaryBegin(BoundaryMixed)))
 		l += n
 		n, _ = w.Write([]byte("MIME-Version: 1.0\r\n"))
 		l += n
-		n, _ = w.Write([]byte("Content-Type: multipart/related;\r\n\tboundary=\"" + boundaryRelated + "\"\r\n"))
+		n, _ = w.Write([]byte("Content-Type: multipart/related;\r\n\tboundary=\"" + m.boundary(BoundaryRelated) + "\"\r\n"))
 		l += n
 		n, _ = w.Write([]byte("\r\n"))
 		l += n
-		fmt.Println("l=", l)
 	}(bodyHash)
-	bh, err := rsa.SignPKCS1v15(rand.Reader, privateKey, hasher, bodyHash.Sum(nil))
+	bh, err := rsa.SignPKCS1v15(m.random(), privateKey, hasher, bodyHash.Sum(nil))
 	if err != nil {
 		return err
 	}
 
 	w.Write([]byte(fmt.Sprintf(
-		"DKIM-Signature: v=1; a=rsa-sha1; s=%s; d=%s; c=simple/simple; q=dns/txt; i=%s; a=rsa-sha256; l=%d; h=From : To : Subject; bh=%s; b=%s;\r\n",
-		m.dkimSelector, domain, m.from.email, l, base64.StdEncoding.EncodeToString(bh), base64.StdEncoding.EncodeToString(b))),
+		"DKIM-Signature: v=1; a=rsa-sha1; s=%s; d=%s; c=simple/simple; q=dns/txt; i=%s; a=rsa-sha256; l=%d; h=%s; bh=%s; b=%s;\r\n",
+		m.dkimSelector, domain, identity, l, strings.Join(headerNames, " : "), base64.StdEncoding.EncodeToString(bh), base64.StdEncoding.EncodeToString(b))),
 	)
 
 	/*
@@ -229,121 +322,200 @@ func (m Message) SignDKIM(w io.Writer) error {
 	return nil
 }
 
-func (m Message) HeaderWrite(w io.Writer) {
-	w.Write([]byte("MIME-Version: 1.0\r\n"))
-	w.Write([]byte("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n"))
-	w.Write([]byte("From: " + m.from.String() + "\r\n"))
-	w.Write([]byte("To: " + JoinMails(m.to) + "\r\n"))
-	if len(m.cc) > 0 {
-		w.Write([]byte("Cc: " + JoinMails(m.cc) + "\r\n"))
+// dkimHeaders заголовки, которые подписываются DKIM, в порядке h=
+func (m Message) dkimHeaders() ([]header, error) {
+	headers, err := m.headerList()
+	if err != nil {
+		return nil, err
 	}
-	if len(m.cc) > 0 {
-		w.Write([]byte("Bcc: " + JoinMails(m.bcc) + "\r\n"))
+	var signed []header
+	for i := range headers {
+		if dkimSignedHeaders[headers[i].name] {
+			signed = append(signed, headers[i])
+		}
 	}
+	return signed, nil
+}
 
-	if m.returnPath.email != "" {
-		w.Write([]byte("Return-Path: " + m.returnPath.String() + "\r\n"))
+func (m Message) HeaderWrite(writer io.Writer) (int64, error) {
+	w := newErrWriter(writer)
+	n := w.n
+	headers, err := m.headerList()
+	if err != nil {
+		return 0, err
+	}
+	messageID, err := m.messageID()
+	if err != nil {
+		return 0, err
 	}
-	w.Write([]byte("Content-Type: multipart/mixed;\r\n\tboundary=\"" + boundaryMixed + "\"\r\n"))
-	w.Write([]byte("Subject: " + mime.BEncoding.Encode("utf-8", m.subject) + "\r\n"))
+	w.Write([]byte("MIME-Version: 1.0\r\n"))
+	w.Write([]byte("Date: " + m.now().Format(time.RFC1123Z) + "\r\n"))
+	w.Write([]byte("Message-ID: <" + messageID + ">\r\n"))
+	for i := range headers {
+		w.Write([]byte(headers[i].name + ": " + headers[i].value + "\r\n"))
+	}
+	w.Write([]byte("Content-Type: multipart/mixed;\r\n\tboundary=\"" + m.boundary(BoundaryMixed) + "\"\r\n"))
 	w.Write([]byte("\r\n"))
 	w.Write([]byte("This is a multi-part message in MIME format.\r\n"))
 	w.Write([]byte("\r\n"))
+	return w.n - n, w.err
 }
 
-func (m Message) BodyWrite(w io.Writer) {
+func (m Message) BodyWrite(writer io.Writer) (int64, error) {
+	w := newErrWriter(writer)
+	n := w.n
 	// Начинаем наше multipart/mixed письмо
 	// У нас будут зависящие друг от друга блоки с mixed разделителем вверху
 	{
-		w.Write([]byte(boundaryMixedBegin))
-		w.Write([]byte("MIME-Version: 1.0\r\n"))
-		w.Write([]byte("Content-Type: multipart/related;\r\n\tboundary=\"" + boundaryRelated + "\"\r\n"))
-		w.Write([]byte("\r\n"))
+		w.Write([]byte(m.boundaryBegin(BoundaryMixed)))
+
+		// Первым блоком идёт текст письма: версии на разных языках или зависящие блоки
+		err := m.validateLanguages()
+		if err != nil {
+			return w.n - n, err
+		}
+		if len(m.languages) > 0 && !m.multilingualPlain {
+			err = m.multilingualWrite(w)
+		} else if len(m.languages) > 0 {
+			err = m.relatedWrite(w, m.multilingualText(), "", "")
+		} else {
+			err = m.relatedWrite(w, m.textPlain, m.textAMP, m.textHTML)
+		}
+		if err != nil {
+			return w.n - n, err
+		}
+
+		// Если есть файлы для вложения
+		if len(m.attachmentFile) > 0 {
+			// Будем все отправлять
+			for i := range m.attachmentFile {
+				// Сперва соберём необходимую информацию о файле
+				var (
+					// нам нужно имя файла
+					fileName string
+					// его размер
+					fileSize string
+					// и mime тип
+					fileMime string
+				)
+				fileName = m.attachmentFile[i].fileName()
+				size, err := m.attachmentFile[i].size()
+				if err != nil {
+					return w.n - n, err
+				}
+				fileSize = strconv.FormatInt(size, 10)
+				fileMime, err = m.attachmentFile[i].mimeType()
+				if err != nil {
+					return w.n - n, err
+				}
+				// Пишем заголовок для файла с mixed разделителем вверху
+				w.Write([]byte(m.boundaryBegin(BoundaryMixed)))
+				w.Write([]byte("Content-Type: " + fileMime + ";\r\n\tname=\"" + fileName + "\"\r\n"))
+				w.Write([]byte("Content-Transfer-Encoding: base64\r\n"))
+				w.Write([]byte("Content-Disposition: attachment;\r\n\tfilename=\"" + fileName + "\"; size=" + fileSize + ";\r\n"))
+				w.Write([]byte("\r\n"))
+				// Пишем файл кодируя в base64 с переносами строк через каждые 76 символов
+				if m.sizeOnly {
+					w.skip(base64Len(size))
+				} else {
+					r, err := m.attachmentFile[i].reader()
+					if err != nil {
+						return w.n - n, err
+					}
+					if err = base64ReaderWriter(w, r); err != nil {
+						return w.n - n, err
+					}
+				}
+				w.Write([]byte("\r\n"))
+			}
+		}
+
+	}
+
+	// И закрываем наше сообщение
+	w.Write([]byte(m.boundaryEnd(BoundaryMixed)))
+	return w.n - n, w.err
+}
+
+// relatedWrite пишет блок multipart/related: альтернативные версии текста и зависящие файлы
+func (m Message) relatedWrite(w *errWriter, textPlain, textAMP, textHTML string) error {
+	// Перекодируем тексты заранее, чтобы не оборвать блок на середине
+	textPlain, err := m.encodeString(textPlain)
+	if err != nil {
+		return err
+	}
+	textHTML, err = m.encodeString(textHTML)
+	if err != nil {
+		return err
+	}
+	w.Write([]byte("MIME-Version: 1.0\r\n"))
+	w.Write([]byte("Content-Type: multipart/related;\r\n\tboundary=\"" + m.boundary(BoundaryRelated) + "\"\r\n"))
+	w.Write([]byte("\r\n"))
+
+	// Первым зависящим блоком будут альтернативные версии с related разделителем вверху
+	{
+		w.Write([]byte(m.boundaryBegin(BoundaryRelated)))
 
-		// Первым зависящим блоком будут альтернативные версии с related разделителем вверху
 		{
-			w.Write([]byte(boundaryRelatedBegin))
+			w.Write([]byte("MIME-Version: 1.0\r\n"))
+			w.Write([]byte("Content-Type: multipart/alternative;\r\n\tboundary=\"" + m.boundary(BoundaryAlternative) + "\"\r\n"))
+			w.Write([]byte("\r\n"))
 
-			{
+			// Если textPlain не пуст добавляем блок text/plain с alternative разделителем вверху
+			if textPlain != "" {
+				w.Write([]byte(m.boundaryBegin(BoundaryAlternative)))
 				w.Write([]byte("MIME-Version: 1.0\r\n"))
-				w.Write([]byte("Content-Type: multipart/alternative;\r\n\tboundary=\"" + boundaryAlternative + "\"\r\n"))
+				w.Write([]byte("Content-Type: text/plain;\r\n\tcharset=\"" + m.getCharset() + "\"\r\n"))
+				w.Write([]byte("Content-Transfer-Encoding: base64\r\n"))
 				w.Write([]byte("\r\n"))
-
-				// Если textPlain не пуст добавляем блок text/plain с alternative разделителем вверху
-				if m.textPlain != "" {
-					w.Write([]byte(boundaryAlternativeBegin))
-					w.Write([]byte("MIME-Version: 1.0\r\n"))
-					w.Write([]byte("Content-Type: text/plain;\r\n\tcharset=\"utf-8\"\r\n"))
-					w.Write([]byte("Content-Transfer-Encoding: base64\r\n"))
-					w.Write([]byte("\r\n"))
-					// Пишем textPlain кодируя аналогично textHTML
-					base64TextWriter(w, m.textPlain)
-					w.Write([]byte("\r\n"))
-					w.Write([]byte("\r\n"))
+				// Пишем textPlain кодируя аналогично textHTML
+				if err := base64TextWriter(w, textPlain); err != nil {
+					return err
 				}
+				w.Write([]byte("\r\n"))
+				w.Write([]byte("\r\n"))
+			}
 
-				// Если textHTML не пуст добавляем альтернативный блок text/html с alternative разделителем вверху
-				if m.textHTML != "" {
-					w.Write([]byte(boundaryAlternativeBegin))
-					w.Write([]byte("MIME-Version: 1.0\r\n"))
-					w.Write([]byte("Content-Type: text/html;\r\n\tcharset=\"utf-8\"\r\n"))
-					w.Write([]byte("Content-Transfer-Encoding: base64\r\n"))
-					w.Write([]byte("\r\n"))
-					// Пишем textHTML кодируя его в base64 с переводом строки и возвратом каретки каждые 76 символов
-					base64TextWriter(w, m.textHTML)
-					w.Write([]byte("\r\n"))
-					w.Write([]byte("\r\n"))
+			// Если textAMP не пуст добавляем блок text/x-amp-html, он должен быть между text/plain и text/html
+			// AMP всегда в utf-8, независимо от кодировки остального письма
+			if textAMP != "" {
+				w.Write([]byte(m.boundaryBegin(BoundaryAlternative)))
+				w.Write([]byte("MIME-Version: 1.0\r\n"))
+				w.Write([]byte("Content-Type: text/x-amp-html;\r\n\tcharset=\"utf-8\"\r\n"))
+				w.Write([]byte("Content-Transfer-Encoding: base64\r\n"))
+				w.Write([]byte("\r\n"))
+				if err := base64TextWriter(w, textAMP); err != nil {
+					return err
 				}
-
-				// Закрываем блок альтернатив
-				w.Write([]byte(boundaryAlternativeEnd))
 				w.Write([]byte("\r\n"))
-
+				w.Write([]byte("\r\n"))
 			}
 
-			// Если есть зависящие файлы
-			if len(m.relatedFile) > 0 {
-				// Будем все отправлять
-				for i := range m.relatedFile {
-					// Сперва соберём необходимую информацию о файле
-					var (
-						// нам нужно имя файла
-						fileName string
-						// его размер
-						fileSize string
-						// и mime тип
-						fileMime string
-					)
-					fileName = filepath.Base(m.relatedFile[i].Name())
-					info, _ := m.relatedFile[i].Stat()
-					fileSize = strconv.FormatInt(info.Size(), 10)
-					buf := make([]byte, 512)
-					m.relatedFile[i].Read(buf)
-					fileMime = http.DetectContentType(buf)
-					// Вернём курсор чтения файла в начало
-					m.relatedFile[i].Seek(0, 0)
-					// Пишем заголовок для файла с related разделителем вверху
-					w.Write([]byte(boundaryRelatedBegin))
-					w.Write([]byte("Content-Type: " + fileMime + ";\r\n\tname=\"" + fileName + "\"\r\n"))
-					w.Write([]byte("Content-Transfer-Encoding: base64\r\n"))
-					w.Write([]byte("Content-ID: <" + fileName + ">\r\n"))
-					w.Write([]byte("Content-Disposition: inline;\r\n\tfilename=\"" + fileName + "\"; size=" + fileSize + ";\r\n"))
-					w.Write([]byte("\r\n"))
-					// Пишем файл кодируя в base64 с переносами строк через каждые 76 символов
-					base64FileWriter(w, m.relatedFile[i])
-					w.Write([]byte("\r\n"))
+			// Если textHTML не пуст добавляем альтернативный блок text/html с alternative разделителем вверху
+			if textHTML != "" {
+				w.Write([]byte(m.boundaryBegin(BoundaryAlternative)))
+				w.Write([]byte("MIME-Version: 1.0\r\n"))
+				w.Write([]byte("Content-Type: text/html;\r\n\tcharset=\"" + m.getCharset() + "\"\r\n"))
+				w.Write([]byte("Content-Transfer-Encoding: base64\r\n"))
+				w.Write([]byte("\r\n"))
+				// Пишем textHTML кодируя его в base64 с переводом строки и возвратом каретки каждые 76 символов
+				if err := base64TextWriter(w, textHTML); err != nil {
+					return err
 				}
+				w.Write([]byte("\r\n"))
+				w.Write([]byte("\r\n"))
 			}
 
-			// Закрываем блок зависящих
-			w.Write([]byte(boundaryRelatedEnd))
+			// Закрываем блок альтернатив
+			w.Write([]byte(m.boundaryEnd(BoundaryAlternative)))
 			w.Write([]byte("\r\n"))
+
 		}
 
-		// Если есть файлы для вложения
-		if len(m.attachmentFile) > 0 {
+		// Если есть зависящие файлы
+		if len(m.relatedFile) > 0 {
 			// Будем все отправлять
-			for i := range m.attachmentFile {
+			for i := range m.relatedFile {
 				// Сперва соберём необходимую информацию о файле
 				var (
 					// нам нужно имя файла
@@ -353,28 +525,42 @@ func (m Message) BodyWrite(w io.Writer) {
 					// и mime тип
 					fileMime string
 				)
-				fileName = filepath.Base(m.attachmentFile[i].Name())
-				info, _ := m.attachmentFile[i].Stat()
-				fileSize = strconv.FormatInt(info.Size(), 10)
-				buf := make([]byte, 512)
-				m.attachmentFile[i].Read(buf)
-				fileMime = http.DetectContentType(buf)
-				// Вернём курсор чтения файла в начало
-				m.attachmentFile[i].Seek(0, 0)
-				// Пишем заголовок для файла с mixed разделителем вверху
-				w.Write([]byte(boundaryMixedBegin))
+				fileName = m.relatedFile[i].fileName()
+				size, err := m.relatedFile[i].size()
+				if err != nil {
+					return err
+				}
+				fileSize = strconv.FormatInt(size, 10)
+				fileMime, err = m.relatedFile[i].mimeType()
+				if err != nil {
+					return err
+				}
+				// Пишем заголовок для файла с related разделителем вверху
+				w.Write([]byte(m.boundaryBegin(BoundaryRelated)))
 				w.Write([]byte("Content-Type: " + fileMime + ";\r\n\tname=\"" + fileName + "\"\r\n"))
 				w.Write([]byte("Content-Transfer-Encoding: base64\r\n"))
-				w.Write([]byte("Content-Disposition: attachment;\r\n\tfilename=\"" + fileName + "\"; size=" + fileSize + ";\r\n"))
+				w.Write([]byte("Content-ID: <" + fileName + ">\r\n"))
+				w.Write([]byte("Content-Disposition: inline;\r\n\tfilename=\"" + fileName + "\"; size=" + fileSize + ";\r\n"))
 				w.Write([]byte("\r\n"))
 				// Пишем файл кодируя в base64 с переносами строк через каждые 76 символов
-				base64FileWriter(w, m.attachmentFile[i])
+				if m.sizeOnly {
+					w.skip(base64Len(size))
+				} else {
+					r, err := m.relatedFile[i].reader()
+					if err != nil {
+						return err
+					}
+					if err = base64ReaderWriter(w, r); err != nil {
+						return err
+					}
+				}
 				w.Write([]byte("\r\n"))
 			}
 		}
 
+		// Закрываем блок зависящих
+		w.Write([]byte(m.boundaryEnd(BoundaryRelated)))
+		w.Write([]byte("\r\n"))
 	}
-
-	// И закрываем наше сообщение
-	w.Write([]byte(boundaryMixedEnd))
+	return w.err
 }
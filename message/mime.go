@@ -0,0 +1,136 @@
+package message
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// extensionTypes типы, которые http.DetectContentType определяет неверно,
+// а mime.TypeByExtension зависит от системных таблиц
+var extensionTypes = map[string]string{
+	".csv":  "text/csv",
+	".tsv":  "text/tab-separated-values",
+	".txt":  "text/plain",
+	".md":   "text/markdown",
+	".html": "text/html",
+	".htm":  "text/html",
+	".css":  "text/css",
+	".ics":  "text/calendar",
+	".vcf":  "text/vcard",
+	".xml":  "application/xml",
+	".json": "application/json",
+	".svg":  "image/svg+xml",
+	".webp": "image/webp",
+	".pdf":  "application/pdf",
+	".zip":  "application/zip",
+	".eml":  "message/rfc822",
+	".doc":  "application/msword",
+	".xls":  "application/vnd.ms-excel",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+}
+
+// mimeType тип содержимого файла: явно заданный, по расширению или по первым 512 байтам,
+// для текстовых типов добавляется charset
+func (p part) mimeType() (string, error) {
+	if p.contentType != "" {
+		return p.contentType, nil
+	}
+	buf := make([]byte, 512)
+	l, err := p.readerAt().ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	fileMime := contentTypeByExtension(p.fileName())
+	if fileMime == "" {
+		fileMime = http.DetectContentType(buf[:l])
+	}
+	mediaType, params, err := mime.ParseMediaType(fileMime)
+	if err != nil {
+		return fileMime, nil
+	}
+	if !strings.HasPrefix(mediaType, "text/") && mediaType != "image/svg+xml" {
+		return fileMime, nil
+	}
+	// Кодировку проверяем по всему файлу, а не по первым байтам
+	r, err := p.reader()
+	if err != nil {
+		return "", err
+	}
+	charset, err := detectCharset(r)
+	if err != nil {
+		return "", err
+	}
+	delete(params, "charset")
+	if charset != "" {
+		params["charset"] = charset
+	}
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+func contentTypeByExtension(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == "" {
+		return ""
+	}
+	if t, ok := extensionTypes[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// detectCharset возвращает us-ascii или utf-8, если текст в них корректен, иначе пустую строку
+func detectCharset(r io.Reader) (string, error) {
+	var (
+		ascii = true
+		buf   = make([]byte, 32*1024)
+		tail  int
+	)
+	for {
+		n, err := r.Read(buf[tail:])
+		n += tail
+		tail = 0
+		chunk := buf[:n]
+		if err == nil {
+			// Неполный символ в конце дочитаем со следующим блоком
+			for i := 1; i < utf8.UTFMax && i <= len(chunk); i++ {
+				if utf8.RuneStart(chunk[len(chunk)-i]) {
+					if !utf8.FullRune(chunk[len(chunk)-i:]) {
+						tail = i
+					}
+					break
+				}
+			}
+			chunk = chunk[:n-tail]
+		}
+		for _, b := range chunk {
+			if b >= utf8.RuneSelf {
+				ascii = false
+				break
+			}
+		}
+		if !utf8.Valid(chunk) {
+			return "", nil
+		}
+		copy(buf, buf[n-tail:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if ascii {
+		return "us-ascii", nil
+	}
+	return "utf-8", nil
+}
@@ -0,0 +1,173 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+)
+
+// https://tools.ietf.org/html/rfc8255
+
+const boundaryMultilingual = "===============0_MULTILINGUAL="
+
+// defaultMultilingualPreface пояснение для почтовых программ, которые не знают multipart/multilingual
+const defaultMultilingualPreface = "This is a message in multiple languages. It says the same thing in each language.\r\n" +
+	"Это письмо на нескольких языках. На каждом языке в нём написано одно и то же.\r\n"
+
+// https://tools.ietf.org/html/rfc8255#section-4.3
+type TranslationType string
+
+const (
+	TranslationOriginal  TranslationType = "original"
+	TranslationHuman     TranslationType = "human"
+	TranslationAutomated TranslationType = "automated"
+)
+
+// language версия текста письма на одном языке
+type language struct {
+	tag             string
+	translationType TranslationType
+	subject         string
+	textPlain       string
+	textHTML        string
+}
+
+// AddLanguage добавляет версию письма на языке tag (ru, en, en-GB ...) с переведённой темой.
+// Первый добавленный язык считается оригиналом, остальные переводом человеком.
+// Если языки добавлены, то TextPlain, TextHTML и TextAMP не пишутся
+func (m *Message) AddLanguage(tag, subject, textPlain, textHTML string) *Message {
+	translationType := TranslationHuman
+	if len(m.languages) == 0 {
+		translationType = TranslationOriginal
+	}
+	return m.AddLanguageType(tag, translationType, subject, textPlain, textHTML)
+}
+
+// AddLanguageType добавляет версию письма на языке с явно заданным типом перевода
+func (m *Message) AddLanguageType(tag string, translationType TranslationType, subject, textPlain, textHTML string) *Message {
+	m.languages = append(m.languages, language{
+		tag:             tag,
+		translationType: translationType,
+		subject:         subject,
+		textPlain:       textPlain,
+		textHTML:        textHTML,
+	})
+	return m
+}
+
+// MultilingualPreface пояснение в начале multipart/multilingual, которое увидят
+// почтовые программы без его поддержки. Оно должно быть на всех языках письма
+func (m *Message) MultilingualPreface(preface string) *Message {
+	m.multilingualPreface = preface
+	return m
+}
+
+// MultilingualPlain вместо multipart/multilingual писать все языки один за другим
+// в одной части text/plain, для получателей, чьи программы его не понимают
+func (m *Message) MultilingualPlain(plain bool) *Message {
+	m.multilingualPlain = plain
+	return m
+}
+
+func (m Message) getMultilingualPreface() string {
+	if m.multilingualPreface == "" {
+		return defaultMultilingualPreface
+	}
+	return m.multilingualPreface
+}
+
+// multilingualSubject тема для письма без своей темы: темы всех языков через " / "
+func (m Message) multilingualSubject() string {
+	subjects := make([]string, 0, len(m.languages))
+	for i := range m.languages {
+		if m.languages[i].subject != "" {
+			subjects = append(subjects, m.languages[i].subject)
+		}
+	}
+	return strings.Join(subjects, " / ")
+}
+
+// contentLanguage значение Content-Language для письма, где все языки в одной части
+func (m Message) contentLanguage() string {
+	tags := make([]string, len(m.languages))
+	for i := range m.languages {
+		tags[i] = m.languages[i].tag
+	}
+	return strings.Join(tags, ", ")
+}
+
+// multilingualText все языки одним текстом для режима MultilingualPlain
+func (m Message) multilingualText() string {
+	texts := make([]string, len(m.languages))
+	for i := range m.languages {
+		texts[i] = "[" + m.languages[i].tag + "] " + m.languages[i].subject + "\r\n\r\n" + m.languages[i].textPlain
+		if m.languages[i].textPlain == "" {
+			texts[i] += htmlToText(m.languages[i].textHTML)
+		}
+	}
+	return strings.Join(texts, "\r\n\r\n----------\r\n\r\n")
+}
+
+func (m Message) validateLanguages() error {
+	for i := range m.languages {
+		l := m.languages[i]
+		if l.tag == "" || strings.ContainsAny(l.tag, " \t\r\n,;") {
+			return fmt.Errorf("bad language tag %q", l.tag)
+		}
+		switch l.translationType {
+		case TranslationOriginal, TranslationHuman, TranslationAutomated:
+		default:
+			return fmt.Errorf("bad translation type %q for language %s", l.translationType, l.tag)
+		}
+		if strings.ContainsAny(l.subject, "\r\n") {
+			return fmt.Errorf("bad subject for language %s: must not contain CR or LF", l.tag)
+		}
+	}
+	return nil
+}
+
+// multilingualWrite пишет блок multipart/multilingual: пояснение и по вложенному письму на каждый язык
+func (m Message) multilingualWrite(w *errWriter) error {
+	from, err := m.encodeMail(m.from)
+	if err != nil {
+		return err
+	}
+	preface, err := m.encodeString(m.getMultilingualPreface())
+	if err != nil {
+		return err
+	}
+	w.Write([]byte("MIME-Version: 1.0\r\n"))
+	w.Write([]byte("Content-Type: multipart/multilingual;\r\n\tboundary=\"" + m.boundary(BoundaryMultilingual) + "\"\r\n"))
+	w.Write([]byte("\r\n"))
+
+	// Первой частью идёт пояснение
+	w.Write([]byte(m.boundaryBegin(BoundaryMultilingual)))
+	w.Write([]byte("Content-Type: text/plain;\r\n\tcharset=\"" + m.getCharset() + "\"\r\n"))
+	w.Write([]byte("Content-Transfer-Encoding: base64\r\n"))
+	w.Write([]byte("\r\n"))
+	if err = base64TextWriter(w, preface); err != nil {
+		return err
+	}
+	w.Write([]byte("\r\n"))
+
+	// Каждый язык это вложенное письмо со своей темой, зависящие файлы общие для всех языков
+	for i := range m.languages {
+		subject, err := m.encodeHeader(m.languages[i].subject)
+		if err != nil {
+			return err
+		}
+		w.Write([]byte(m.boundaryBegin(BoundaryMultilingual)))
+		w.Write([]byte("Content-Type: message/rfc822\r\n"))
+		w.Write([]byte("Content-Language: " + m.languages[i].tag + "\r\n"))
+		w.Write([]byte("Content-Translation-Type: " + string(m.languages[i].translationType) + "\r\n"))
+		w.Write([]byte("\r\n"))
+		w.Write([]byte("From: " + from + "\r\n"))
+		w.Write([]byte("Subject: " + subject + "\r\n"))
+		if err = m.relatedWrite(w, m.languages[i].textPlain, "", m.languages[i].textHTML); err != nil {
+			return err
+		}
+	}
+
+	w.Write([]byte(m.boundaryEnd(BoundaryMultilingual)))
+	w.Write([]byte("\r\n"))
+	return w.err
+}
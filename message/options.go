@@ -0,0 +1,139 @@
+package message
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// BoundaryKind вид multipart блока, для которого нужен разделитель
+type BoundaryKind string
+
+const (
+	BoundaryMixed        BoundaryKind = "mixed"
+	BoundaryRelated      BoundaryKind = "related"
+	BoundaryAlternative  BoundaryKind = "alternative"
+	BoundaryMultilingual BoundaryKind = "multilingual"
+)
+
+var defaultBoundaries = map[BoundaryKind]string{
+	BoundaryMixed:        boundaryMixed,
+	BoundaryRelated:      boundaryRelated,
+	BoundaryAlternative:  boundaryAlternative,
+	BoundaryMultilingual: boundaryMultilingual,
+}
+
+// maxBoundaryLength https://tools.ietf.org/html/rfc2046#section-5.1.1
+const maxBoundaryLength = 70
+
+// WriterOptions источники времени, разделителей, Message-ID и случайности для записи письма.
+// Если все они детерминированы, то письмо записывается байт в байт одинаково, например для сравнения
+// с эталонными .eml файлами
+type WriterOptions struct {
+	// Now время для Date и mbox, по умолчанию time.Now
+	Now func() time.Time
+	// Boundary разделитель для блока kind, по умолчанию постоянные разделители из message.txt.
+	// Вызывается один раз на вид блока за запись, длина не должна меняться от раза к разу,
+	// иначе EncodedSize не совпадёт с размером записанного письма
+	Boundary func(kind BoundaryKind) string
+	// MessageID значение Message-ID без угловых скобок, domain это домен отправителя,
+	// по умолчанию 32 случайных hex символа из Rand @ domain
+	MessageID func(domain string) string
+	// Rand источник случайности для Message-ID и подписи DKIM, по умолчанию crypto/rand.Reader
+	Rand io.Reader
+}
+
+// WriterOptions задаёт источники времени, разделителей, Message-ID и случайности
+func (m *Message) WriterOptions(options WriterOptions) *Message {
+	m.options = options
+	return m
+}
+
+func (m Message) now() time.Time {
+	if m.options.Now == nil {
+		return time.Now()
+	}
+	return m.options.Now()
+}
+
+func (m Message) random() io.Reader {
+	if m.options.Rand == nil {
+		return rand.Reader
+	}
+	return m.options.Rand
+}
+
+// withBoundaries копия письма с разделителями на всю запись, чтобы генератор вызывался один раз
+func (m Message) withBoundaries() (Message, error) {
+	if m.options.Boundary == nil || m.boundaries != nil {
+		return m, nil
+	}
+	m.boundaries = make(map[BoundaryKind]string, len(defaultBoundaries))
+	for kind := range defaultBoundaries {
+		b := m.options.Boundary(kind)
+		if err := validBoundary(b); err != nil {
+			return m, fmt.Errorf("bad %s boundary %q: %s", kind, b, err)
+		}
+		m.boundaries[kind] = b
+	}
+	return m, nil
+}
+
+func (m Message) boundary(kind BoundaryKind) string {
+	if b, ok := m.boundaries[kind]; ok {
+		return b
+	}
+	if m.options.Boundary != nil {
+		return m.options.Boundary(kind)
+	}
+	return defaultBoundaries[kind]
+}
+
+func (m Message) boundaryBegin(kind BoundaryKind) string {
+	return "--" + m.boundary(kind) + "\r\n"
+}
+
+func (m Message) boundaryEnd(kind BoundaryKind) string {
+	return "--" + m.boundary(kind) + "--\r\n"
+}
+
+// validBoundary https://tools.ietf.org/html/rfc2046#section-5.1.1
+func validBoundary(b string) error {
+	if b == "" || len(b) > maxBoundaryLength {
+		return fmt.Errorf("length must be from 1 to %d", maxBoundaryLength)
+	}
+	if strings.HasSuffix(b, " ") {
+		return fmt.Errorf("must not end with space")
+	}
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("'()+_,-./:=? ", c) >= 0 {
+			continue
+		}
+		return fmt.Errorf("character %q is not allowed", c)
+	}
+	return nil
+}
+
+// messageID значение Message-ID без угловых скобок
+func (m Message) messageID() (string, error) {
+	domain := "localhost"
+	if i := strings.LastIndex(m.from.email, "@"); i >= 0 && i < len(m.from.email)-1 {
+		domain = m.from.email[i+1:]
+	}
+	if m.options.MessageID != nil {
+		id := m.options.MessageID(domain)
+		if id == "" || strings.ContainsAny(id, "<>\r\n\t ") {
+			return "", fmt.Errorf("bad Message-ID %q", id)
+		}
+		return id, nil
+	}
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(m.random(), b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b) + "@" + domain, nil
+}
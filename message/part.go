@@ -0,0 +1,53 @@
+package message
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// part файл для вложения или зависящий файл, содержимое берётся из file или из data
+type part struct {
+	file *os.File
+	// name имя для data, для file если пусто, то берётся имя файла
+	name string
+	data []byte
+	// contentType заданный явно тип, если пуст, то определяется автоматически
+	contentType string
+}
+
+func (p part) fileName() string {
+	if p.file == nil || p.name != "" {
+		return p.name
+	}
+	return filepath.Base(p.file.Name())
+}
+
+func (p part) size() (int64, error) {
+	if p.file == nil {
+		return int64(len(p.data)), nil
+	}
+	info, err := p.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (p part) readerAt() io.ReaderAt {
+	if p.file == nil {
+		return bytes.NewReader(p.data)
+	}
+	return p.file
+}
+
+// reader содержимое с начала, позиция чтения файла не меняется,
+// так что файл можно писать несколько раз, например для каждого получателя
+func (p part) reader() (io.Reader, error) {
+	size, err := p.size()
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(p.readerAt(), 0, size), nil
+}
@@ -0,0 +1,199 @@
+package message
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultImageMaxSize = 5 * 1024 * 1024
+	defaultImageTimeout = 10 * time.Second
+)
+
+// remoteImageRegexp src у img и background у любых тегов с http(s) адресом
+var remoteImageRegexp = regexp.MustCompile(`(?i)(<img\b[^>]*?\bsrc\s*=\s*|<[a-z][^>]*?\bbackground\s*=\s*)("https?://[^"]+"|'https?://[^']+'|https?://[^\s>]+)`)
+
+// imageExtensions расширения для распространённых типов картинок, mime.ExtensionsByType
+// отдаёт их в неудобном порядке, например .jfif для image/jpeg
+var imageExtensions = map[string]string{
+	"image/jpeg":               ".jpg",
+	"image/png":                ".png",
+	"image/gif":                ".gif",
+	"image/webp":               ".webp",
+	"image/bmp":                ".bmp",
+	"image/svg+xml":            ".svg",
+	"image/tiff":               ".tiff",
+	"image/x-icon":             ".ico",
+	"image/vnd.microsoft.icon": ".ico",
+	"image/avif":               ".avif",
+}
+
+type remoteImage struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// ImageFetcher скачивает картинки из HTML письма, чтобы вложить их в письмо как зависящие файлы.
+// Скачанные картинки кешируются по URL, так что один ImageFetcher стоит использовать для всей рассылки
+type ImageFetcher struct {
+	// Client если nil, то http.DefaultClient
+	Client *http.Client
+	// MaxSize максимальный размер одной картинки
+	MaxSize int64
+	// Timeout на скачивание одной картинки
+	Timeout time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*remoteImage
+}
+
+func NewImageFetcher(client *http.Client) *ImageFetcher {
+	return &ImageFetcher{
+		Client:  client,
+		MaxSize: defaultImageMaxSize,
+		Timeout: defaultImageTimeout,
+		cache:   map[string]*remoteImage{},
+	}
+}
+
+// EmbedRemoteImages скачивает http(s) картинки из TextHTML, добавляет их зависящими файлами
+// и заменяет ссылки на cid:. Картинки, которые не удалось скачать, остаются ссылками,
+// а ошибки по ним возвращаются одной ошибкой
+func (m *Message) EmbedRemoteImages(f *ImageFetcher) error {
+	var (
+		errs []string
+		// cid уже добавленных картинок по URL, чтобы одна картинка не вкладывалась дважды
+		embedded = map[string]string{}
+		names    = map[string]bool{}
+	)
+	for i := range m.relatedFile {
+		names[m.relatedFile[i].fileName()] = true
+	}
+	m.textHTML = remoteImageRegexp.ReplaceAllStringFunc(m.textHTML, func(match string) string {
+		sub := remoteImageRegexp.FindStringSubmatch(match)
+		quoted := sub[2]
+		link := strings.Trim(quoted, `"'`)
+		rawURL := html.UnescapeString(link)
+		if cid, ok := embedded[rawURL]; ok {
+			return sub[1] + strings.Replace(quoted, link, "cid:"+cid, 1)
+		}
+		img, err := f.fetch(rawURL)
+		if err != nil {
+			errs = append(errs, err.Error())
+			return match
+		}
+		// Content-ID зависящего файла это его имя, поэтому имена должны быть уникальны
+		name := img.name
+		for n := 1; names[name]; n++ {
+			name = strconv.Itoa(n) + "_" + img.name
+		}
+		names[name] = true
+		embedded[rawURL] = name
+		m.relatedFile = append(m.relatedFile, part{name: name, data: img.data, contentType: img.contentType})
+		return sub[1] + strings.Replace(quoted, link, "cid:"+name, 1)
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("can not embed images: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (f *ImageFetcher) fetch(rawURL string) (*remoteImage, error) {
+	f.mu.Lock()
+	if f.cache == nil {
+		f.cache = map[string]*remoteImage{}
+	}
+	img, ok := f.cache[rawURL]
+	f.mu.Unlock()
+	if ok {
+		return img, nil
+	}
+
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	maxSize := f.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultImageMaxSize
+	}
+	timeout := f.Timeout
+	if timeout <= 0 {
+		timeout = defaultImageTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: bad status %s", rawURL, resp.Status)
+	}
+	if resp.ContentLength > maxSize {
+		return nil, fmt.Errorf("%s: size %d exceeds max size %d", rawURL, resp.ContentLength, maxSize)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", rawURL, err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("%s: size exceeds max size %d", rawURL, maxSize)
+	}
+
+	// Доверяем заголовку только если он говорит о картинке, иначе смотрим на содержимое
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(contentType, "image/") {
+		contentType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("%s: content type %s is not an image", rawURL, contentType)
+	}
+
+	img = &remoteImage{
+		name:        imageName(resp.Request.URL.Path, contentType),
+		contentType: contentType,
+		data:        data,
+	}
+	f.mu.Lock()
+	f.cache[rawURL] = img
+	f.mu.Unlock()
+	return img, nil
+}
+
+// imageName имя файла из пути URL, с расширением по типу, если его нет
+func imageName(urlPath, contentType string) string {
+	name := path.Base(urlPath)
+	if name == "." || name == "/" {
+		name = "image"
+	}
+	// Имя идёт в Content-ID, так что оставляем только безопасные символы
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+	if path.Ext(name) == "" {
+		name += imageExtensions[contentType]
+	}
+	return name
+}
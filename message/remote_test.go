@@ -0,0 +1,110 @@
+package message
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func remoteServer(t *testing.T) *httptest.Server {
+	gif, err := base64.StdEncoding.DecodeString(goldenGIF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/logo.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\n"))
+	})
+	mux.HandleFunc("/photo", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte{0xff, 0xd8, 0xff})
+	})
+	// Заголовок не про картинку, тип определяется по содержимому
+	mux.HandleFunc("/pixel", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(gif)
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	})
+	mux.HandleFunc("/slow.gif", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestEmbedRemoteImages(t *testing.T) {
+	server := remoteServer(t)
+	m := NewMessage().TextHTML(`<img src="` + server.URL + `/logo.png"><img src='` + server.URL + `/logo.png'>` +
+		`<img src="` + server.URL + `/photo"><td background="` + server.URL + `/pixel">`)
+	if err := m.EmbedRemoteImages(NewImageFetcher(server.Client())); err != nil {
+		t.Fatal(err)
+	}
+	expected := `<img src="cid:logo.png"><img src='cid:logo.png'><img src="cid:photo.jpg"><td background="cid:pixel.gif">`
+	if m.textHTML != expected {
+		t.Fatalf("expected %s, got %s", expected, m.textHTML)
+	}
+	// Одна картинка вкладывается один раз
+	types := map[string]string{"logo.png": "image/png", "photo.jpg": "image/jpeg", "pixel.gif": "image/gif"}
+	if len(m.relatedFile) != len(types) {
+		t.Fatalf("expected %d related files, got %d", len(types), len(m.relatedFile))
+	}
+	for _, p := range m.relatedFile {
+		if types[p.name] != p.contentType {
+			t.Errorf("%s: expected content type %q, got %q", p.name, types[p.name], p.contentType)
+		}
+	}
+}
+
+func TestEmbedRemoteImagesErrors(t *testing.T) {
+	server := remoteServer(t)
+	f := NewImageFetcher(server.Client())
+	f.Timeout = 100 * time.Millisecond
+	tests := []struct {
+		path string
+		err  string
+	}{
+		{"/missing.png", "bad status 404"},
+		{"/page", "is not an image"},
+		{"/slow.gif", "deadline exceeded"},
+	}
+	for _, test := range tests {
+		html := `<img src="` + server.URL + test.path + `">`
+		m := NewMessage().TextHTML(html)
+		err := m.EmbedRemoteImages(f)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.path, test.err, err)
+		}
+		// Картинка, которую не удалось скачать, остаётся ссылкой
+		if m.textHTML != html || len(m.relatedFile) != 0 {
+			t.Errorf("%s: message changed: %s", test.path, m.textHTML)
+		}
+	}
+}
+
+func TestImageName(t *testing.T) {
+	tests := []struct {
+		path, contentType, expected string
+	}{
+		{"/img/logo.png", "image/png", "logo.png"},
+		{"/img/photo", "image/jpeg", "photo.jpg"},
+		{"/", "image/gif", "image.gif"},
+		{"/a b?.svg", "image/svg+xml", "a_b_.svg"},
+		{"/unknown", "image/x-unknown", "unknown"},
+	}
+	for _, test := range tests {
+		if name := imageName(test.path, test.contentType); name != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.path, test.expected, name)
+		}
+	}
+}
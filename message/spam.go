@@ -0,0 +1,188 @@
+package message
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	defaultSpamThreshold = 5.0
+	// bulkRecipients с какого количества получателей письмо считается массовым
+	bulkRecipients = 10
+	// imageTextRatio сколько символов текста должно приходиться на одну картинку
+	imageTextRatio = 200
+)
+
+var (
+	htmlTagRegexp    = regexp.MustCompile(`(?s)<[^>]*>`)
+	htmlScriptRegexp = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)>`)
+	htmlImgRegexp    = regexp.MustCompile(`(?i)<img\b`)
+	htmlLinkRegexp   = regexp.MustCompile(`(?is)<a\b[^>]*?\bhref\s*=\s*["']?([^"'\s>]+)[^>]*>(.*?)</a>`)
+	textURLRegexp    = regexp.MustCompile(`(?i)^(https?://)?([a-z0-9-]+\.)+[a-z]{2,}(/\S*)?$`)
+	plainURLRegexp   = regexp.MustCompile(`(?i)https?://\S+`)
+)
+
+var urlShorteners = []string{
+	"bit.ly", "goo.gl", "t.co", "tinyurl.com", "ow.ly", "is.gd", "buff.ly",
+	"cutt.ly", "rebrand.ly", "shorturl.at", "clck.ru", "tiny.cc", "s.id",
+}
+
+var suspiciousExtensions = map[string]bool{
+	".exe": true, ".scr": true, ".bat": true, ".cmd": true, ".com": true, ".pif": true,
+	".js": true, ".jse": true, ".vbs": true, ".vbe": true, ".wsf": true, ".jar": true,
+	".msi": true, ".ps1": true, ".hta": true, ".lnk": true, ".iso": true, ".cpl": true,
+}
+
+// SpamChecker оценивает содержимое письма по правилам наподобие body правил SpamAssassin
+type SpamChecker struct {
+	// ForbiddenWords слова, за каждое из которых в теме или тексте начисляются баллы
+	ForbiddenWords []string
+	// Threshold с какого количества баллов письмо считается спамом, по умолчанию 5
+	Threshold float64
+}
+
+// SpamRule сработавшее правило
+type SpamRule struct {
+	Name        string
+	Score       float64
+	Description string
+}
+
+type SpamReport struct {
+	Score     float64
+	Threshold float64
+	Rules     []SpamRule
+}
+
+func (r SpamReport) IsSpam() bool {
+	return r.Score >= r.Threshold
+}
+
+func (r SpamReport) String() string {
+	lines := []string{fmt.Sprintf("score %.1f of %.1f", r.Score, r.Threshold)}
+	for i := range r.Rules {
+		lines = append(lines, fmt.Sprintf("%4.1f %s: %s", r.Rules[i].Score, r.Rules[i].Name, r.Rules[i].Description))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Check считает баллы письма
+func (c SpamChecker) Check(m Message) SpamReport {
+	report := SpamReport{Threshold: c.Threshold}
+	if report.Threshold <= 0 {
+		report.Threshold = defaultSpamThreshold
+	}
+	hit := func(name string, score float64, format string, a ...interface{}) {
+		report.Rules = append(report.Rules, SpamRule{Name: name, Score: score, Description: fmt.Sprintf(format, a...)})
+		report.Score += score
+	}
+
+	htmlText := htmlToText(m.textHTML)
+	if m.textHTML != "" {
+		images := len(htmlImgRegexp.FindAllString(m.textHTML, -1))
+		textLen := len([]rune(strings.TrimSpace(htmlText)))
+		switch {
+		case images > 0 && textLen == 0:
+			hit("HTML_IMAGE_ONLY", 2.5, "HTML has %d images and no text", images)
+		case images > 0 && textLen/images < imageTextRatio:
+			hit("HTML_IMAGE_RATIO", 1.5, "HTML has %d images and only %d characters of text", images, textLen)
+		}
+		if m.textPlain == "" {
+			hit("MIME_HTML_ONLY", 1.0, "HTML body has no text/plain alternative")
+		}
+	}
+
+	if subjectAllCaps(m.subject) {
+		hit("SUBJ_ALL_CAPS", 1.5, "subject is written in capitals")
+	}
+
+	var links []string
+	for _, match := range htmlLinkRegexp.FindAllStringSubmatch(m.textHTML, -1) {
+		href := html.UnescapeString(match[1])
+		if !strings.HasPrefix(strings.ToLower(href), "http") {
+			continue
+		}
+		links = append(links, href)
+		text := strings.TrimSpace(htmlToText(match[2]))
+		if !textURLRegexp.MatchString(text) {
+			continue
+		}
+		if textHost, hrefHost := linkHost(text), linkHost(href); textHost != "" && hrefHost != "" && textHost != hrefHost {
+			hit("LINK_MISMATCH", 2.0, "link text %s points to %s", text, hrefHost)
+		}
+	}
+	links = append(links, plainURLRegexp.FindAllString(m.textPlain, -1)...)
+	for _, link := range links {
+		host := linkHost(link)
+		for _, shortener := range urlShorteners {
+			if host == shortener || strings.HasSuffix(host, "."+shortener) {
+				hit("URL_SHORTENER", 1.5, "link %s uses URL shortener", link)
+				break
+			}
+		}
+	}
+
+	for i := range m.attachmentFile {
+		name := m.attachmentFile[i].fileName()
+		if suspiciousExtensions[strings.ToLower(filepath.Ext(name))] {
+			hit("SUSPICIOUS_ATTACHMENT", 3.0, "attachment %s has executable type", name)
+		}
+	}
+
+	if len(c.ForbiddenWords) > 0 {
+		text := strings.ToLower(m.subject + "\n" + m.textPlain + "\n" + htmlText)
+		for _, word := range c.ForbiddenWords {
+			if word != "" && strings.Contains(text, strings.ToLower(word)) {
+				hit("FORBIDDEN_WORD", 1.0, "contains forbidden word %q", word)
+			}
+		}
+	}
+
+	if m.isBulk() && m.unsubscribeMailto == "" && m.unsubscribeURL == "" {
+		hit("BULK_NO_UNSUBSCRIBE", 2.0, "bulk message has no List-Unsubscribe header")
+	}
+
+	return report
+}
+
+// isBulk письмо похоже на массовую рассылку
+func (m Message) isBulk() bool {
+	precedence := strings.ToLower(m.precedence)
+	return m.listID != "" || precedence == "bulk" || precedence == "list" || len(m.GetRecipientEmails()) >= bulkRecipients
+}
+
+func htmlToText(s string) string {
+	s = htmlScriptRegexp.ReplaceAllString(s, " ")
+	s = htmlTagRegexp.ReplaceAllString(s, " ")
+	return strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+}
+
+func subjectAllCaps(subject string) bool {
+	var letters int
+	for _, r := range subject {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		if unicode.IsLower(r) {
+			return false
+		}
+		letters++
+	}
+	return letters >= 5
+}
+
+func linkHost(link string) string {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
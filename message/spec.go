@@ -0,0 +1,424 @@
+package message
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SpecVersion текущая версия формата MessageSpec
+const SpecVersion = 1
+
+// specPartTimeout время на скачивание файла по URL из MessageSpec
+const specPartTimeout = 30 * time.Second
+
+var priorityNames = map[Priority]string{
+	PriorityHigh:   "high",
+	PriorityNormal: "normal",
+	PriorityLow:    "low",
+}
+
+// MessageSpec описание письма, которое можно сохранить в JSON или YAML,
+// общий формат для CLI, HTTP API и черновиков
+type MessageSpec struct {
+	Version       int               `json:"version" yaml:"version"`
+	From          AddressSpec       `json:"from" yaml:"from"`
+	Sender        *AddressSpec      `json:"sender,omitempty" yaml:"sender,omitempty"`
+	ReplyTo       []AddressSpec     `json:"reply_to,omitempty" yaml:"reply_to,omitempty"`
+	To            []AddressSpec     `json:"to,omitempty" yaml:"to,omitempty"`
+	Cc            []AddressSpec     `json:"cc,omitempty" yaml:"cc,omitempty"`
+	Bcc           []AddressSpec     `json:"bcc,omitempty" yaml:"bcc,omitempty"`
+	ReturnPath    *AddressSpec      `json:"return_path,omitempty" yaml:"return_path,omitempty"`
+	VERP          bool              `json:"verp,omitempty" yaml:"verp,omitempty"`
+	Subject       string            `json:"subject,omitempty" yaml:"subject,omitempty"`
+	TextPlain     string            `json:"text_plain,omitempty" yaml:"text_plain,omitempty"`
+	TextAMP       string            `json:"text_amp,omitempty" yaml:"text_amp,omitempty"`
+	TextHTML      string            `json:"text_html,omitempty" yaml:"text_html,omitempty"`
+	Languages     []LanguageSpec    `json:"languages,omitempty" yaml:"languages,omitempty"`
+	Multilingual  *MultilingualSpec `json:"multilingual,omitempty" yaml:"multilingual,omitempty"`
+	Charset       string            `json:"charset,omitempty" yaml:"charset,omitempty"`
+	Organization  string            `json:"organization,omitempty" yaml:"organization,omitempty"`
+	Priority      string            `json:"priority,omitempty" yaml:"priority,omitempty"`
+	AutoSubmitted string            `json:"auto_submitted,omitempty" yaml:"auto_submitted,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	List          *ListSpec         `json:"list,omitempty" yaml:"list,omitempty"`
+	Related       []PartSpec        `json:"related,omitempty" yaml:"related,omitempty"`
+	Attachments   []PartSpec        `json:"attachments,omitempty" yaml:"attachments,omitempty"`
+	DKIM          *DKIMSpec         `json:"dkim,omitempty" yaml:"dkim,omitempty"`
+	MaxSize       int64             `json:"max_size,omitempty" yaml:"max_size,omitempty"`
+}
+
+type AddressSpec struct {
+	Name  string `json:"name,omitempty" yaml:"name,omitempty"`
+	Email string `json:"email" yaml:"email"`
+}
+
+// PartSpec файл письма, содержимое берётся из одного из Path, URL или Base64
+type PartSpec struct {
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+	URL  string `json:"url,omitempty" yaml:"url,omitempty"`
+	// Base64 содержимое прямо в описании, для него обязательно Name
+	Base64 string `json:"base64,omitempty" yaml:"base64,omitempty"`
+	// Name имя файла, для Path и URL по умолчанию берётся из них
+	Name        string `json:"name,omitempty" yaml:"name,omitempty"`
+	ContentType string `json:"content_type,omitempty" yaml:"content_type,omitempty"`
+}
+
+// LanguageSpec версия письма на одном языке, без TranslationType первый язык оригинал, остальные перевод человеком
+type LanguageSpec struct {
+	Tag             string `json:"tag" yaml:"tag"`
+	TranslationType string `json:"translation_type,omitempty" yaml:"translation_type,omitempty"`
+	Subject         string `json:"subject,omitempty" yaml:"subject,omitempty"`
+	TextPlain       string `json:"text_plain,omitempty" yaml:"text_plain,omitempty"`
+	TextHTML        string `json:"text_html,omitempty" yaml:"text_html,omitempty"`
+}
+
+type MultilingualSpec struct {
+	Preface string `json:"preface,omitempty" yaml:"preface,omitempty"`
+	// Plain все языки в одной части text/plain
+	Plain bool `json:"plain,omitempty" yaml:"plain,omitempty"`
+}
+
+type ListSpec struct {
+	ID                string `json:"id,omitempty" yaml:"id,omitempty"`
+	UnsubscribeMailto string `json:"unsubscribe_mailto,omitempty" yaml:"unsubscribe_mailto,omitempty"`
+	UnsubscribeURL    string `json:"unsubscribe_url,omitempty" yaml:"unsubscribe_url,omitempty"`
+	Precedence        string `json:"precedence,omitempty" yaml:"precedence,omitempty"`
+	FeedbackID        string `json:"feedback_id,omitempty" yaml:"feedback_id,omitempty"`
+}
+
+// DKIMSpec ключ можно указать прямо в PrivateKey или файлом в KeyFile
+type DKIMSpec struct {
+	Selector   string `json:"selector" yaml:"selector"`
+	Domain     string `json:"domain,omitempty" yaml:"domain,omitempty"`
+	KeyFile    string `json:"key_file,omitempty" yaml:"key_file,omitempty"`
+	PrivateKey string `json:"private_key,omitempty" yaml:"private_key,omitempty"`
+}
+
+// ParseSpec читает MessageSpec из JSON или YAML (JSON тоже YAML) и проверяет версию
+func ParseSpec(data []byte) (*MessageSpec, error) {
+	var spec MessageSpec
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+	if spec.Version == 0 {
+		return nil, fmt.Errorf("message spec version is missing")
+	}
+	if spec.Version > SpecVersion {
+		return nil, fmt.Errorf("unsupported message spec version %d, max supported %d", spec.Version, SpecVersion)
+	}
+	return &spec, nil
+}
+
+// YAML описание письма в YAML
+func (s MessageSpec) YAML() ([]byte, error) {
+	return yaml.Marshal(s)
+}
+
+func (a AddressSpec) mail() Mail {
+	return NewMail(a.Name, a.Email)
+}
+
+func addressSpec(m Mail) AddressSpec {
+	return AddressSpec{Name: m.name, Email: m.email}
+}
+
+func addressSpecs(ms []Mail) []AddressSpec {
+	if len(ms) == 0 {
+		return nil
+	}
+	specs := make([]AddressSpec, len(ms))
+	for i := range ms {
+		specs[i] = addressSpec(ms[i])
+	}
+	return specs
+}
+
+// ToMessage собирает письмо по описанию. Файлы из Path открываются и остаются открытыми,
+// их закрывает Message.Close
+func (s MessageSpec) ToMessage() (*Message, error) {
+	if s.Version > SpecVersion {
+		return nil, fmt.Errorf("unsupported message spec version %d, max supported %d", s.Version, SpecVersion)
+	}
+	m := NewMessage().
+		From(s.From.mail()).
+		VERP(s.VERP).
+		Subject(s.Subject).
+		TextPlain(s.TextPlain).
+		TextAMP(s.TextAMP).
+		TextHTML(s.TextHTML).
+		Charset(s.Charset).
+		Organization(s.Organization).
+		AutoSubmitted(AutoSubmitted(s.AutoSubmitted)).
+		MaxSize(s.MaxSize)
+	if s.Sender != nil {
+		m.Sender(s.Sender.mail())
+	}
+	for i := range s.ReplyTo {
+		m.ReplyTo(s.ReplyTo[i].mail())
+	}
+	for i := range s.To {
+		m.To(s.To[i].mail())
+	}
+	for i := range s.Cc {
+		m.Cc(s.Cc[i].mail())
+	}
+	for i := range s.Bcc {
+		m.Bcc(s.Bcc[i].mail())
+	}
+	if s.ReturnPath != nil {
+		m.ReturnPath(s.ReturnPath.mail())
+	}
+	for i := range s.Languages {
+		l := s.Languages[i]
+		if l.TranslationType == "" {
+			m.AddLanguage(l.Tag, l.Subject, l.TextPlain, l.TextHTML)
+		} else {
+			m.AddLanguageType(l.Tag, TranslationType(l.TranslationType), l.Subject, l.TextPlain, l.TextHTML)
+		}
+	}
+	if s.Multilingual != nil {
+		m.MultilingualPreface(s.Multilingual.Preface).MultilingualPlain(s.Multilingual.Plain)
+	}
+	if s.Priority != "" {
+		var ok bool
+		for priority, name := range priorityNames {
+			if strings.EqualFold(s.Priority, name) {
+				m.Priority(priority)
+				ok = true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("bad priority %q", s.Priority)
+		}
+	}
+	if len(s.Headers) > 0 {
+		m.AddHeaders(s.Headers)
+	}
+	if s.List != nil {
+		m.ListID(s.List.ID).
+			ListUnsubscribe(s.List.UnsubscribeMailto, s.List.UnsubscribeURL).
+			Precedence(s.List.Precedence).
+			FeedbackID(s.List.FeedbackID)
+	}
+	if s.DKIM != nil {
+		key := s.DKIM.PrivateKey
+		if s.DKIM.KeyFile != "" {
+			b, err := ioutil.ReadFile(s.DKIM.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			key = string(b)
+		}
+		m.SetDKIM(s.DKIM.Selector, key).DKIMDomain(s.DKIM.Domain)
+	}
+
+	for i := range s.Related {
+		p, err := s.Related[i].part()
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.relatedFile = append(m.relatedFile, p)
+	}
+	for i := range s.Attachments {
+		p, err := s.Attachments[i].part()
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.attachmentFile = append(m.attachmentFile, p)
+	}
+	return m, nil
+}
+
+func (s PartSpec) part() (part, error) {
+	p := part{name: s.Name, contentType: s.ContentType}
+	switch {
+	case s.Path != "":
+		f, err := os.Open(s.Path)
+		if err != nil {
+			return part{}, err
+		}
+		p.file = f
+	case s.URL != "":
+		client := http.Client{Timeout: specPartTimeout}
+		resp, err := client.Get(s.URL)
+		if err != nil {
+			return part{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return part{}, fmt.Errorf("%s: bad status %s", s.URL, resp.Status)
+		}
+		if p.data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return part{}, fmt.Errorf("%s: %s", s.URL, err)
+		}
+		if p.name == "" {
+			p.name = path.Base(resp.Request.URL.Path)
+		}
+	case s.Base64 != "":
+		if s.Name == "" {
+			return part{}, fmt.Errorf("inline part must have a name")
+		}
+		data, err := base64.StdEncoding.DecodeString(s.Base64)
+		if err != nil {
+			return part{}, err
+		}
+		p.data = data
+	default:
+		return part{}, fmt.Errorf("part %q has no path, url or base64 content", s.Name)
+	}
+	return p, nil
+}
+
+// FromMessage описание письма. Файлы сохраняются путями, а данные без файла в base64
+func FromMessage(m *Message) MessageSpec {
+	s := MessageSpec{
+		Version:       SpecVersion,
+		From:          addressSpec(m.from),
+		ReplyTo:       addressSpecs(m.replyTo),
+		To:            addressSpecs(m.to),
+		Cc:            addressSpecs(m.cc),
+		Bcc:           addressSpecs(m.bcc),
+		VERP:          m.verp,
+		Subject:       m.subject,
+		TextPlain:     m.textPlain,
+		TextAMP:       m.textAMP,
+		TextHTML:      m.textHTML,
+		Charset:       m.charset,
+		Organization:  m.organization,
+		Priority:      priorityNames[m.priority],
+		AutoSubmitted: string(m.autoSubmitted),
+		MaxSize:       m.maxSize,
+	}
+	for i := range m.languages {
+		s.Languages = append(s.Languages, LanguageSpec{
+			Tag:             m.languages[i].tag,
+			TranslationType: string(m.languages[i].translationType),
+			Subject:         m.languages[i].subject,
+			TextPlain:       m.languages[i].textPlain,
+			TextHTML:        m.languages[i].textHTML,
+		})
+	}
+	if m.multilingualPreface != "" || m.multilingualPlain {
+		s.Multilingual = &MultilingualSpec{Preface: m.multilingualPreface, Plain: m.multilingualPlain}
+	}
+	if m.sender.email != "" {
+		sender := addressSpec(m.sender)
+		s.Sender = &sender
+	}
+	if m.returnPath.email != "" {
+		returnPath := addressSpec(m.returnPath)
+		s.ReturnPath = &returnPath
+	}
+	if len(m.headers) > 0 {
+		s.Headers = make(map[string]string, len(m.headers))
+		for k, v := range m.headers {
+			s.Headers[k] = v
+		}
+	}
+	if m.listID != "" || m.unsubscribeMailto != "" || m.unsubscribeURL != "" || m.precedence != "" || m.feedbackID != "" {
+		s.List = &ListSpec{
+			ID:                m.listID,
+			UnsubscribeMailto: m.unsubscribeMailto,
+			UnsubscribeURL:    m.unsubscribeURL,
+			Precedence:        m.precedence,
+			FeedbackID:        m.feedbackID,
+		}
+	}
+	if m.dkimSelector != "" {
+		s.DKIM = &DKIMSpec{
+			Selector:   m.dkimSelector,
+			Domain:     m.dkimDomain,
+			PrivateKey: m.dkimPrivateKey,
+		}
+	}
+	for i := range m.relatedFile {
+		s.Related = append(s.Related, partSpec(m.relatedFile[i]))
+	}
+	for i := range m.attachmentFile {
+		s.Attachments = append(s.Attachments, partSpec(m.attachmentFile[i]))
+	}
+	return s
+}
+
+func partSpec(p part) PartSpec {
+	if p.file != nil {
+		return PartSpec{Path: p.file.Name(), Name: p.name, ContentType: p.contentType}
+	}
+	return PartSpec{Base64: base64.StdEncoding.EncodeToString(p.data), Name: p.name, ContentType: p.contentType}
+}
+
+// Inline переносит содержимое файлов из Path и URL в Base64, чтобы описание
+// не зависело от файлов, например для черновика
+func (s *MessageSpec) Inline() error {
+	for _, parts := range [][]PartSpec{s.Related, s.Attachments} {
+		for i := range parts {
+			if parts[i].Base64 != "" {
+				continue
+			}
+			p, err := parts[i].part()
+			if err != nil {
+				return err
+			}
+			data := p.data
+			if p.file != nil {
+				data, err = ioutil.ReadAll(p.file)
+				p.file.Close()
+				if err != nil {
+					return err
+				}
+			}
+			parts[i] = PartSpec{
+				Base64:      base64.StdEncoding.EncodeToString(data),
+				Name:        p.fileName(),
+				ContentType: p.contentType,
+			}
+		}
+	}
+	return nil
+}
+
+// CheckInline проверяет, что описание ничего не берёт снаружи: нет файлов из Path, URL и DKIM.KeyFile.
+// Описания из недоверенных источников, например из HTTP запроса, надо проверять до ToMessage,
+// иначе по ним можно прочитать любой файл сервера или сходить на любой адрес из его сети
+func (s MessageSpec) CheckInline() error {
+	for _, parts := range [][]PartSpec{s.Related, s.Attachments} {
+		for i := range parts {
+			if parts[i].Path != "" {
+				return fmt.Errorf("part %q: path is not allowed", parts[i].Name)
+			}
+			if parts[i].URL != "" {
+				return fmt.Errorf("part %q: url is not allowed", parts[i].Name)
+			}
+		}
+	}
+	if s.DKIM != nil && s.DKIM.KeyFile != "" {
+		return fmt.Errorf("dkim key_file is not allowed")
+	}
+	return nil
+}
+
+// Close закрывает все файлы письма
+func (m *Message) Close() error {
+	var err error
+	for _, parts := range [][]part{m.relatedFile, m.attachmentFile} {
+		for i := range parts {
+			if parts[i].file == nil {
+				continue
+			}
+			if cerr := parts[i].file.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
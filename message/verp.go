@@ -0,0 +1,63 @@
+package message
+
+import (
+	"strings"
+)
+
+// https://cr.yp.to/proto/verp.txt
+
+const (
+	verpDelimiter       = "+"
+	verpDomainDelimiter = "="
+)
+
+// VERP включает кодирование получателя в адресе отправителя конверта,
+// например bounce+vasiliy=domain.tld@ourdomain для vasiliy@domain.tld
+func (m *Message) VERP(verp bool) *Message {
+	m.verp = verp
+	return m
+}
+
+// GetEnvelopeFrom адрес для MAIL FROM при отправке получателю recipient.
+// Берётся ReturnPath, а если он не задан, то From
+func (m *Message) GetEnvelopeFrom(recipient string) string {
+	sender := m.returnPath.email
+	if sender == "" {
+		sender = m.from.email
+	}
+	if !m.verp {
+		return sender
+	}
+	return EncodeVERP(sender, recipient)
+}
+
+// EncodeVERP кодирует recipient в адрес sender
+func EncodeVERP(sender, recipient string) string {
+	at := strings.LastIndex(sender, "@")
+	rcptAt := strings.LastIndex(recipient, "@")
+	if at < 0 || rcptAt < 0 {
+		return sender
+	}
+	return sender[:at] + verpDelimiter + recipient[:rcptAt] + verpDomainDelimiter + recipient[rcptAt+1:] + sender[at:]
+}
+
+// DecodeVERP получает исходного получателя из адреса возврата, например из To баунса.
+// sender адрес отправителя конверта без VERP, как в EncodeVERP, ok false если address получен не из него
+func DecodeVERP(sender, address string) (recipient string, ok bool) {
+	at := strings.LastIndex(sender, "@")
+	addressAt := strings.LastIndex(address, "@")
+	if at < 0 || addressAt < 0 || !strings.EqualFold(sender[at:], address[addressAt:]) {
+		return "", false
+	}
+	// В локальной части sender тоже может быть +, поэтому отрезаем её целиком
+	prefix := sender[:at] + verpDelimiter
+	if !strings.HasPrefix(address[:addressAt], prefix) {
+		return "", false
+	}
+	encoded := address[len(prefix):addressAt]
+	e := strings.LastIndex(encoded, verpDomainDelimiter)
+	if e <= 0 || e == len(encoded)-1 {
+		return "", false
+	}
+	return encoded[:e] + "@" + encoded[e+1:], true
+}
@@ -0,0 +1,37 @@
+package message
+
+import "testing"
+
+func TestVERP(t *testing.T) {
+	tests := []struct {
+		sender, recipient string
+	}{
+		{"bounce@ourdomain.tld", "vasiliy@domain.tld"},
+		{"bounce+list@ourdomain.tld", "vasiliy@domain.tld"},
+		{"bounce@ourdomain.tld", "vasiliy+news@domain.tld"},
+		{"bounce@ourdomain.tld", "vasiliy=1@domain.tld"},
+	}
+	for _, test := range tests {
+		address := EncodeVERP(test.sender, test.recipient)
+		if recipient, ok := DecodeVERP(test.sender, address); !ok || recipient != test.recipient {
+			t.Errorf("%s: expected %s, got %s %v", address, test.recipient, recipient, ok)
+		}
+	}
+}
+
+func TestDecodeVERPForeign(t *testing.T) {
+	for _, address := range []string{
+		"bounce@ourdomain.tld",
+		"bounce+vasiliy=domain.tld@otherdomain.tld",
+		"other+vasiliy=domain.tld@ourdomain.tld",
+		"bounce+vasiliy@ourdomain.tld",
+		"bounce+list@ourdomain.tld",
+	} {
+		if recipient, ok := DecodeVERP("bounce+list@ourdomain.tld", address); ok {
+			t.Errorf("%s: expected not ours, got %s", address, recipient)
+		}
+	}
+	if recipient, ok := DecodeVERP("bounce@ourdomain.tld", "bounce+vasiliy=domain.tld@OurDomain.tld"); !ok || recipient != "vasiliy@domain.tld" {
+		t.Errorf("expected vasiliy@domain.tld, got %s %v", recipient, ok)
+	}
+}
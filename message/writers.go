@@ -3,39 +3,93 @@ package message
 import (
 	"encoding/base64"
 	"io"
-	"os"
 	"strings"
 )
 
-type delimitWriter struct {
-	n      int
+// 76 from RFC
+const lineLength = 76
+
+// errWriter считает записанные байты и запоминает первую ошибку записи,
+// после ошибки все последующие записи пропускаются
+type errWriter struct {
+	n      int64
+	err    error
+	writer io.Writer
+}
+
+func newErrWriter(writer io.Writer) *errWriter {
+	if ew, ok := writer.(*errWriter); ok {
+		return ew
+	}
+	return &errWriter{writer: writer}
+}
+
+func (w *errWriter) Write(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, w.err = w.writer.Write(p)
+	w.n += int64(n)
+	return n, w.err
+}
+
+// skip учитывает n байт без записи, используется при подсчёте размера письма
+func (w *errWriter) skip(n int64) {
+	if w.err == nil {
+		w.n += n
+	}
+}
+
+// base64Len размер base64 представления n байт с переносами строк через каждые 76 символов
+func base64Len(n int64) int64 {
+	l := (n + 2) / 3 * 4
+	if l == 0 {
+		return 0
+	}
+	return l + (l-1)/lineLength*2
+}
+
+// lineWriter разбивает поток на строки по cnt байт разделителем dr,
+// каждый вызов Write приводит к одной записи в нижележащий writer
+type lineWriter struct {
+	col    int
 	cnt    int
 	dr     []byte
+	buf    []byte
 	writer io.Writer
 }
 
-func newDelimitWriter(writer io.Writer, dr []byte, cnt int) *delimitWriter {
-	return &delimitWriter{n: 0, cnt: cnt, dr: dr, writer: writer}
+func newLineWriter(writer io.Writer, dr []byte, cnt int) *lineWriter {
+	return &lineWriter{cnt: cnt, dr: dr, writer: writer}
 }
 
-func (w *delimitWriter) Write(p []byte) (n int, err error) {
-	for i := range p {
-		_, err = w.writer.Write(p[i : i+1])
-		if err != nil {
-			break
+func (w *lineWriter) Write(p []byte) (n int, err error) {
+	w.buf = w.buf[:0]
+	for len(p) > 0 {
+		// Разделитель пишем только перед следующим байтом, чтобы не было пустой строки в конце
+		if w.col == w.cnt {
+			w.buf = append(w.buf, w.dr...)
+			w.col = 0
 		}
-		if w.n++; w.n%w.cnt == 0 {
-			w.writer.Write(w.dr)
-
+		l := w.cnt - w.col
+		if l > len(p) {
+			l = len(p)
 		}
+		w.buf = append(w.buf, p[:l]...)
+		w.col += l
+		n += l
+		p = p[l:]
+	}
+	if _, err = w.writer.Write(w.buf); err != nil {
+		return 0, err
 	}
-	return w.n, err
+	return n, nil
 }
 
-func base64FileWriter(w io.Writer, f *os.File) (err error) {
-	dwr := newDelimitWriter(w, []byte{0x0d, 0x0a}, 76) // 76 from RFC
-	b64Enc := base64.NewEncoder(base64.StdEncoding, dwr)
-	_, err = io.Copy(b64Enc, f)
+func base64ReaderWriter(w io.Writer, r io.Reader) (err error) {
+	lwr := newLineWriter(w, []byte{0x0d, 0x0a}, lineLength)
+	b64Enc := base64.NewEncoder(base64.StdEncoding, lwr)
+	_, err = io.Copy(b64Enc, r)
 	if err != nil {
 		return err
 	}
@@ -44,8 +98,8 @@ func base64FileWriter(w io.Writer, f *os.File) (err error) {
 }
 
 func base64TextWriter(w io.Writer, text string) (err error) {
-	dwr := newDelimitWriter(w, []byte{0x0d, 0x0a}, 76) // 76 from RFC
-	b64Enc := base64.NewEncoder(base64.StdEncoding, dwr)
+	lwr := newLineWriter(w, []byte{0x0d, 0x0a}, lineLength)
+	b64Enc := base64.NewEncoder(base64.StdEncoding, lwr)
 	reader := strings.NewReader(text)
 	_, err = io.Copy(b64Enc, reader)
 	if err != nil {